@@ -0,0 +1,551 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/gcexportdata"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// Diagnostic is a problem found by static analysis.
+type Diagnostic struct {
+	Analyzer string `json:"analyzer"` // name of the analyzer that found the problem
+	File     string `json:"file"`     // path relative to the src folder of the GOPATH
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", d.File, d.Line, d.Column, d.Message, d.Analyzer)
+}
+
+// staticCheck runs the Analyzers over pkg and all its
+// subpackages in the temporary GOPATH. The packages are
+// listed by `go list`, which runs like any other command
+// that touches the plugin's code, and then parsed and
+// type-checked from source in-process (see loadPackages),
+// so none of the plugin's code is executed. Any problems that are found
+// are added to the report and returned.
+func (be BuildEnv) staticCheck(pkg string) ([]Diagnostic, error) {
+	pkgs, err := be.loadPackages(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	var diags []Diagnostic
+	for _, p := range pkgs {
+		ds, err := runAnalyzers(p, Analyzers)
+		if err != nil {
+			return nil, fmt.Errorf("analyzing %s: %v", p.PkgPath, err)
+		}
+		diags = append(diags, ds...)
+	}
+
+	srcDir := filepath.Join(be.tmpGopath, "src")
+	for i := range diags {
+		if rel, err := filepath.Rel(srcDir, diags[i].File); err == nil {
+			diags[i].File = rel
+		}
+		be.log.Println(diags[i])
+	}
+	be.Report.Diagnostics = append(be.Report.Diagnostics, diags...)
+
+	return diags, nil
+}
+
+// loadedPackage is a package that was parsed
+// and type-checked for static analysis.
+type loadedPackage struct {
+	PkgPath    string
+	Fset       *token.FileSet
+	Syntax     []*ast.File
+	OtherFiles []string
+	Types      *types.Package
+	TypesInfo  *types.Info
+	TypesSizes types.Sizes
+}
+
+// listedPackage is the part of the output of
+// `go list -json` that loadPackages needs.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Export     string
+	Standard   bool
+	GoFiles    []string
+	CFiles     []string
+	HFiles     []string
+	SFiles     []string
+	ImportMap  map[string]string
+	DepOnly    bool
+	Error      *struct{ Err string }
+}
+
+// loadPackages lists pkg and its subpackages in the temporary
+// GOPATH, along with all their dependencies, with `go list`
+// (with cgo disabled), and parses and type-checks them from
+// source, except for the standard library, which is loaded
+// from its export data (see stdExportData). Only pkg and its
+// subpackages are returned, with the syntax and type
+// information that analyzers need. Errors are written to the
+// log of the build environment.
+func (be BuildEnv) loadPackages(pkg string) ([]*loadedPackage, error) {
+	// see goTest() for why we use ./...
+	var out bytes.Buffer
+	cmd := be.newCommand(classUntrusted, "go", "list", "-e", "-json", "-deps", "./...")
+	cmd.Dir = be.TemporaryPath(pkg)
+	cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	cmd.Stdout = &out
+	err := be.runCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing packages: %v", err)
+	}
+	var listed []listedPackage
+	var std []string
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var lp listedPackage
+		err := dec.Decode(&lp)
+		if err != nil {
+			return nil, fmt.Errorf("decoding go list output: %v", err)
+		}
+		if lp.ImportPath == "unsafe" {
+			continue
+		}
+		if lp.Standard {
+			std = append(std, lp.ImportPath)
+		}
+		lp.Dir = be.hostPath(lp.Dir)
+		listed = append(listed, lp)
+	}
+	exports, err := be.stdExportData(std)
+	if err != nil {
+		be.log.Printf("compiling the standard library: %v; type-checking it from source", err)
+	}
+
+	// `go list -deps` lists dependencies before the
+	// packages that import them, so every import is
+	// loaded by the time it is needed
+	fset := token.NewFileSet()
+	sizes := types.SizesFor("gc", runtime.GOARCH)
+	checked := map[string]*types.Package{"unsafe": types.Unsafe}
+	var roots []*loadedPackage
+	var errCount int
+	for _, lp := range listed {
+		if lp.Error != nil {
+			be.log.Printf("%s: %s", lp.ImportPath, lp.Error.Err)
+			errCount++
+		}
+
+		if file := exports[lp.ImportPath]; file != "" && lp.DepOnly {
+			typesPkg, err := readExportData(fset, checked, lp.ImportPath, file)
+			if err == nil {
+				checked[lp.ImportPath] = typesPkg
+				continue
+			}
+			be.log.Printf("%s: %v; type-checking it from source", lp.ImportPath, err)
+		}
+
+		var files []*ast.File
+		var mode parser.Mode
+		if !lp.DepOnly {
+			mode = parser.ParseComments
+		}
+		for _, name := range lp.GoFiles {
+			f, err := parser.ParseFile(fset, filepath.Join(lp.Dir, name), nil, mode)
+			if err != nil {
+				be.log.Println(err)
+				errCount++
+			}
+			if f != nil {
+				files = append(files, f)
+			}
+		}
+
+		info := &types.Info{
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Implicits:  make(map[ast.Node]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			Scopes:     make(map[ast.Node]*types.Scope),
+		}
+		conf := types.Config{
+			Importer: importerFunc(func(path string) (*types.Package, error) {
+				if mapped, ok := lp.ImportMap[path]; ok {
+					path = mapped
+				}
+				if p, ok := checked[path]; ok {
+					return p, nil
+				}
+				return nil, fmt.Errorf("package %s was not listed", path)
+			}),
+			IgnoreFuncBodies: lp.DepOnly, // only their API matters
+			Sizes:            sizes,
+			Error: func(err error) {
+				be.log.Println(err)
+				errCount++
+			},
+		}
+		typesPkg, _ := conf.Check(lp.ImportPath, fset, files, info)
+		checked[lp.ImportPath] = typesPkg
+
+		if !lp.DepOnly {
+			var otherFiles []string
+			for _, names := range [][]string{lp.CFiles, lp.HFiles, lp.SFiles} {
+				for _, name := range names {
+					otherFiles = append(otherFiles, filepath.Join(lp.Dir, name))
+				}
+			}
+			roots = append(roots, &loadedPackage{
+				PkgPath:    lp.ImportPath,
+				Fset:       fset,
+				Syntax:     files,
+				OtherFiles: otherFiles,
+				Types:      typesPkg,
+				TypesInfo:  info,
+				TypesSizes: sizes,
+			})
+		}
+	}
+	if errCount > 0 {
+		return nil, fmt.Errorf("%d error(s) loading packages", errCount)
+	}
+	return roots, nil
+}
+
+// importerFunc implements types.Importer.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// stdExportData compiles the packages of the standard library
+// at paths (with cgo disabled, like loadPackages lists them)
+// and returns the files with their export data by import path.
+// The standard library is trusted, so it is compiled by this
+// process's go command rather than in a sandbox, into a build
+// cache of the master GOPATH that is kept for the next time.
+func (be BuildEnv) stdExportData(paths []string) (map[string]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	args := append([]string{"list", "-e", "-json", "-export"}, paths...)
+	cmd := exec.Command("go", args...)
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.Getenv("TMPDIR"),
+		"GOCACHE=" + filepath.Join(be.masterGopath, stdCacheFolder),
+		"CGO_ENABLED=0",
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = be.Log
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	exports := make(map[string]string)
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var lp listedPackage
+		err := dec.Decode(&lp)
+		if err != nil {
+			return nil, fmt.Errorf("decoding go list output: %v", err)
+		}
+		if lp.Standard && lp.Export != "" {
+			exports[lp.ImportPath] = lp.Export
+		}
+	}
+	return exports, nil
+}
+
+// stdCacheFolder is the name of the folder in the master
+// GOPATH (outside of src) that holds the build cache for
+// the export data of the standard library.
+const stdCacheFolder = ".buildworker_gocache"
+
+// readExportData loads the package at path from the export
+// data in file, which `go list -export` reports. The packages
+// it refers to are taken from imports, or added to it.
+func readExportData(fset *token.FileSet, imports map[string]*types.Package, path, file string) (*types.Package, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gcexportdata.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading export data: %v", err)
+	}
+	return gcexportdata.Read(r, fset, imports, path)
+}
+
+// runAnalyzers runs analyzers (and the analyzers they require)
+// on the package p. It is a minimal driver which does not
+// support facts, so analyzers that use facts will see none.
+func runAnalyzers(p *loadedPackage, analyzers []*analysis.Analyzer) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	results := make(map[*analysis.Analyzer]interface{})
+
+	var run func(a *analysis.Analyzer, report bool) error
+	run = func(a *analysis.Analyzer, report bool) error {
+		if _, ok := results[a]; ok {
+			return nil
+		}
+		resultOf := make(map[*analysis.Analyzer]interface{})
+		for _, req := range a.Requires {
+			err := run(req, false)
+			if err != nil {
+				return err
+			}
+			resultOf[req] = results[req]
+		}
+		pass := &analysis.Pass{
+			Analyzer:   a,
+			Fset:       p.Fset,
+			Files:      p.Syntax,
+			OtherFiles: p.OtherFiles,
+			Pkg:        p.Types,
+			TypesInfo:  p.TypesInfo,
+			TypesSizes: p.TypesSizes,
+			ResultOf:   resultOf,
+			Report: func(d analysis.Diagnostic) {
+				if !report {
+					return
+				}
+				pos := p.Fset.Position(d.Pos)
+				diags = append(diags, Diagnostic{
+					Analyzer: a.Name,
+					File:     pos.Filename,
+					Line:     pos.Line,
+					Column:   pos.Column,
+					Message:  d.Message,
+				})
+			},
+			ImportObjectFact:  func(types.Object, analysis.Fact) bool { return false },
+			ExportObjectFact:  func(types.Object, analysis.Fact) {},
+			ImportPackageFact: func(*types.Package, analysis.Fact) bool { return false },
+			ExportPackageFact: func(analysis.Fact) {},
+			AllObjectFacts:    func() []analysis.ObjectFact { return nil },
+			AllPackageFacts:   func() []analysis.PackageFact { return nil },
+		}
+		result, err := a.Run(pass)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.Name, err)
+		}
+		results[a] = result
+		return nil
+	}
+
+	for _, a := range analyzers {
+		err := run(a, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Line < diags[j].Line
+	})
+
+	return diags, nil
+}
+
+// Analyzers is the list of analyzers that are run over
+// plugins as part of the plugin checks. Any problem
+// reported by any of them causes the checks to fail.
+var Analyzers = []*analysis.Analyzer{
+	GofmtAnalyzer,
+	UncheckedErrorAnalyzer,
+	InitAnalyzer,
+	ForbiddenImportAnalyzer,
+}
+
+// ForbiddenImports is the list of import paths that
+// plugins may not import. ForbiddenImportAnalyzer
+// reports any imports of these packages.
+var ForbiddenImports = []string{"os/exec", "unsafe"}
+
+// GofmtAnalyzer reports files that are not formatted
+// according to gofmt.
+var GofmtAnalyzer = &analysis.Analyzer{
+	Name: "gofmt",
+	Doc:  "reports files that are not gofmt'ed",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			filename := pass.Fset.File(f.Pos()).Name()
+			src, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			formatted, err := format.Source(src)
+			if err != nil {
+				return nil, fmt.Errorf("formatting %s: %v", filename, err)
+			}
+			if !bytes.Equal(src, formatted) {
+				pass.Reportf(f.Package, "file is not gofmt'ed")
+			}
+		}
+		return nil, nil
+	},
+}
+
+// UncheckedErrorAnalyzer reports calls to functions
+// that return an error when the error is discarded
+// without being assigned, even to the blank identifier.
+var UncheckedErrorAnalyzer = &analysis.Analyzer{
+	Name:     "errcheck",
+	Doc:      "reports unchecked errors",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+		inspect.Preorder([]ast.Node{(*ast.ExprStmt)(nil)}, func(n ast.Node) {
+			call, ok := n.(*ast.ExprStmt).X.(*ast.CallExpr)
+			if !ok || !returnsError(pass.TypesInfo.TypeOf(call)) {
+				return
+			}
+			if fn, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func); ok {
+				if neverFails[fn.FullName()] {
+					return
+				}
+				pass.Reportf(call.Lparen, "error returned by %s is not checked", fn.Name())
+				return
+			}
+			pass.Reportf(call.Lparen, "error is not checked")
+		})
+		return nil, nil
+	},
+}
+
+// returnsError returns true if t is the error type
+// or a tuple containing the error type.
+func returnsError(t types.Type) bool {
+	errType := types.Universe.Lookup("error").Type()
+	if tuple, ok := t.(*types.Tuple); ok {
+		for i := 0; i < tuple.Len(); i++ {
+			if types.Identical(tuple.At(i).Type(), errType) {
+				return true
+			}
+		}
+		return false
+	}
+	return t != nil && types.Identical(t, errType)
+}
+
+// neverFails is the set of functions which return an error
+// but whose errors are conventionally not checked.
+var neverFails = map[string]bool{
+	"fmt.Print":                      true,
+	"fmt.Printf":                     true,
+	"fmt.Println":                    true,
+	"fmt.Fprint":                     true,
+	"fmt.Fprintf":                    true,
+	"fmt.Fprintln":                   true,
+	"(*bytes.Buffer).Write":          true,
+	"(*bytes.Buffer).WriteByte":      true,
+	"(*bytes.Buffer).WriteRune":      true,
+	"(*bytes.Buffer).WriteString":    true,
+	"(*strings.Builder).Write":       true,
+	"(*strings.Builder).WriteByte":   true,
+	"(*strings.Builder).WriteRune":   true,
+	"(*strings.Builder).WriteString": true,
+}
+
+// InitAnalyzer reports init() functions that have side
+// effects beyond registering the plugin, like starting
+// goroutines, running programs, touching the network,
+// or changing the file system or process environment.
+var InitAnalyzer = &analysis.Analyzer{
+	Name: "initeffects",
+	Doc:  "reports suspicious side effects in init functions",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			for _, decl := range f.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Recv != nil || fn.Name.Name != "init" || fn.Body == nil {
+					continue
+				}
+				ast.Inspect(fn.Body, func(n ast.Node) bool {
+					switch n := n.(type) {
+					case *ast.GoStmt:
+						pass.Reportf(n.Go, "goroutine started in init()")
+					case *ast.CallExpr:
+						callee, ok := typeutil.Callee(pass.TypesInfo, n).(*types.Func)
+						if !ok || callee.Pkg() == nil {
+							break
+						}
+						names, ok := initSideEffects[callee.Pkg().Path()]
+						if ok && (names == nil || names[callee.Name()]) {
+							pass.Reportf(n.Lparen, "call to %s in init()", callee.FullName())
+						}
+					}
+					return true
+				})
+			}
+		}
+		return nil, nil
+	},
+}
+
+// initSideEffects maps import paths to the names of functions
+// which should not be called from init(). A nil map means
+// any function in the package.
+var initSideEffects = map[string]map[string]bool{
+	"os/exec":  nil,
+	"net":      nil,
+	"net/http": nil,
+	"syscall":  nil,
+	"plugin":   nil,
+	"os": {
+		"Chdir": true, "Chmod": true, "Chown": true, "Create": true,
+		"Exit": true, "Mkdir": true, "MkdirAll": true, "OpenFile": true,
+		"Remove": true, "RemoveAll": true, "Rename": true, "Setenv": true,
+		"Unsetenv": true, "Clearenv": true, "Symlink": true, "Link": true,
+	},
+	"io/ioutil": {"WriteFile": true, "TempDir": true, "TempFile": true},
+}
+
+// ForbiddenImportAnalyzer reports imports of any
+// of the packages listed in ForbiddenImports.
+var ForbiddenImportAnalyzer = &analysis.Analyzer{
+	Name: "forbiddenimports",
+	Doc:  "reports imports of forbidden packages",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			for _, imp := range f.Imports {
+				path, err := strconv.Unquote(imp.Path.Value)
+				if err != nil {
+					continue
+				}
+				for _, forbidden := range ForbiddenImports {
+					if path == forbidden {
+						pass.Reportf(imp.Pos(), "import of forbidden package %s", path)
+						break
+					}
+				}
+			}
+		}
+		return nil, nil
+	},
+}
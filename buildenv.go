@@ -9,10 +9,10 @@ import (
 	"go/token"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -33,31 +33,80 @@ import (
 type BuildEnv struct {
 	masterGopath string            // path to the master GOPATH (cache)
 	tmpGopath    string            // path to temporary GOPATH created just for this BuildEnv
+	uid          int               // uid (and gid) that owns the temporary GOPATH and runs commands
+	releaseDir   func()            // marks the temporary GOPATH as no longer in use
+	mounts       *[]string         // file systems mounted in the temporary GOPATH
+	shared       *[]func()         // release the master repositories that the temporary GOPATH shares files with
+	gopathUsage  *gopathUsage      // how the size of the temporary GOPATH changed in each phase
+	buildOnly    bool              // whether this BuildEnv is only used for building (see ForBuild)
+	lockFile     string            // ID of the lock file to pin dependencies to, if any (see WithLock)
 	pkgs         map[string]string // map of package to version that matter to this BuildEnv
+	repos        map[string]string // map of package to the URL to clone it from, if not its import path
 	log          *log.Logger       // the logger to write to
 	Log          *bytes.Buffer     // stores the output of this BuildEnv's log
+	Report       *Report           // structured results of checks run in this BuildEnv
 }
 
 // Open creates a new, provisioned build environment with caddy
 // and the specified plugins at their associated versions. It
 // uses the master GOPATH (from environment) to provision itself
-// efficiently. If this function returns without error, you must
-// close the build environment when you are done.
-func Open(caddyVersion string, plugins []CaddyPlugin) (BuildEnv, error) {
-	tmpGopath, err := newTemporaryGopath()
+// efficiently. Options declare what the build environment is
+// for (see ForBuild and ForDeploy). If this function returns
+// without error, you must close the build environment when you
+// are done.
+func Open(caddyVersion string, plugins []CaddyPlugin, opts ...OpenOption) (BuildEnv, error) {
+	var options openOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	for _, plugin := range plugins {
+		if plugin.Repo != "" {
+			err := checkRepoURL(plugin.Repo)
+			if err != nil {
+				return BuildEnv{}, fmt.Errorf("plugin %s: %v", plugin.Package, err)
+			}
+		}
+	}
+
+	err := CheckMasterGopath()
 	if err != nil {
 		return BuildEnv{}, err
 	}
+	err = checkFreeSpace(os.TempDir(), os.Getenv("GOPATH"))
+	if err != nil {
+		return BuildEnv{}, err
+	}
+	uid, err := leaseUid()
+	if err != nil {
+		return BuildEnv{}, err
+	}
+	tmpGopath, err := newTemporaryGopath(uid)
+	if err != nil {
+		releaseUid(uid)
+		return BuildEnv{}, err
+	}
 	logBuf := new(bytes.Buffer)
 	be := BuildEnv{
 		masterGopath: os.Getenv("GOPATH"),
 		tmpGopath:    tmpGopath,
+		uid:          uid,
+		releaseDir:   UseDir(tmpGopath),
+		mounts:       new([]string),
+		shared:       new([]func()),
+		gopathUsage:  &gopathUsage{size: -1},
+		buildOnly:    options.buildOnly,
+		lockFile:     options.lockFile,
 		pkgs:         make(map[string]string),
+		repos:        make(map[string]string),
 		Log:          logBuf,
 		log:          log.New(logBuf, "", log.Ldate|log.Ltime),
+		Report:       new(Report),
 	}
 	for _, plugin := range plugins {
 		be.pkgs[plugin.Package] = plugin.Version
+		if plugin.Repo != "" {
+			be.repos[plugin.Package] = plugin.Repo
+		}
 	}
 	if caddyVersion == "" {
 		caddyVersion = "master"
@@ -65,7 +114,7 @@ func Open(caddyVersion string, plugins []CaddyPlugin) (BuildEnv, error) {
 	be.pkgs[CaddyPackage] = caddyVersion
 	err = be.provision()
 	if err != nil {
-		os.RemoveAll(tmpGopath)
+		be.Close()
 		return be, fmt.Errorf("provisioning build environment: %v", err)
 	}
 	return be, nil
@@ -85,7 +134,7 @@ func (be BuildEnv) provision() error {
 		if err != nil {
 			return err
 		}
-		err = chown(be.tmpGopath)
+		err = chown(be.tmpGopath, be.uid)
 		if err != nil {
 			return err
 		}
@@ -105,6 +154,8 @@ func (be BuildEnv) provision() error {
 	// copy each package from master GOPATH into temporary GOPATH
 	// and run `git fetch` to ensure we can checkout any version,
 	// then checkout that version in the temporary GOPATH.
+	var repoPaths []string
+	defer func() { be.touchRepos(repoPaths...) }()
 	for pkg, version := range be.pkgs {
 		// use RepoPath (and TemporaryRepoPath) to ensure we copy the
 		// entire git repository so we can run git commands within them,
@@ -112,22 +163,32 @@ func (be BuildEnv) provision() error {
 		// not at the top directory of a repo.
 		srcRepoPath := be.RepoPath(pkg)
 		destRepoPath := be.TemporaryRepoPath(srcRepoPath)
+		repoPaths = append(repoPaths, srcRepoPath)
 
 		// since multiple plugins can share a repository, we need only
 		// copy the repo once; however, this does present a conflict
 		// if the plugins are requested at different versions.
 		if !dirExists(destRepoPath) {
-			err := deepCopy(deepCopyConfig{
-				Source:        srcRepoPath,
-				Dest:          destRepoPath,
-				SkipSymLinks:  true,
-				PreserveOwner: true,
-			})
+			var skip func(string, os.FileInfo) bool
+			if be.buildOnly && pkg != CaddyPackage {
+				skip = skipTestFiles
+			}
+			err := be.copyRepo(srcRepoPath, destRepoPath, skip)
 			if err != nil {
 				return fmt.Errorf("copying %s to %s: %v", srcRepoPath, destRepoPath, err)
 			}
 		}
 
+		// fetch from the plugin's own clone URL (like
+		// a fork), if it has one, instead of from where
+		// the repository in the master GOPATH came from
+		if url, ok := be.repos[pkg]; ok {
+			err := be.setOrigin(destRepoPath, url)
+			if err != nil {
+				return fmt.Errorf("setting origin of %s to %s: %v", pkg, url, err)
+			}
+		}
+
 		// ensure we have the latest refs, to prepare for checkout
 		err = be.gitFetch(be.TemporaryPath(pkg))
 		if err != nil {
@@ -144,6 +205,12 @@ func (be BuildEnv) provision() error {
 		if err != nil {
 			return fmt.Errorf("git checkout %s @ %s: %v", pkg, version, err)
 		}
+		if _, ok := be.repos[pkg]; ok {
+			err = checkPackage(be.TemporaryPath(pkg), pkg)
+			if err != nil {
+				return fmt.Errorf("%s @ %s: %v", be.repos[pkg], version, err)
+			}
+		}
 
 		// run `go get` since the version we just checked out
 		// might have previously-unseen dependencies
@@ -153,13 +220,28 @@ func (be BuildEnv) provision() error {
 		}
 	}
 
+	// check out the dependencies at the commits
+	// they had when the lock file was written
+	if be.lockFile != "" {
+		pinned, err := be.pinDependencies()
+		repoPaths = append(repoPaths, pinned...)
+		if err != nil {
+			return fmt.Errorf("pinning dependencies: %v", err)
+		}
+	}
+
 	return nil
 }
 
-// goGet runs `go get -d -t -x $pkg/...`.
-// It uses both master and temporary GOPATHs.
+// goGet runs `go get -d -t -x $pkg/...`, without -t
+// if the BuildEnv is only used for building. It uses
+// both master and temporary GOPATHs.
 func (be BuildEnv) goGet(pkg string) error {
-	cmd := be.newCommand("go", "get", "-d", "-t", "-x", pkg+"/...")
+	args := []string{"get", "-d", "-t", "-x", pkg + "/..."}
+	if be.buildOnly {
+		args = []string{"get", "-d", "-x", pkg + "/..."}
+	}
+	cmd := be.newCommand(classNetwork, "go", args...)
 	return be.runCommand(cmd)
 }
 
@@ -168,15 +250,17 @@ func (be BuildEnv) goGet(pkg string) error {
 func (be BuildEnv) goVet(pkg string) error {
 	// see goTest() for an explanation of why we
 	// use "./..." and change the dir of the command
-	cmd := be.newCommand("go", "vet", "./...")
+	cmd := be.newCommand(classLocal, "go", "vet", "./...")
 	cmd.Dir = be.TemporaryPath(pkg)
 	return be.runCommand(cmd)
 }
 
-// goTest runs `go test -race $pkg/...`.
-// It uses both master and temporary GOPATHs.
-// TODO: This should be done in a container.
-func (be BuildEnv) goTest(pkg string) error {
+// goTest runs `go test -json -race $pkg/...`. If coverProfile
+// is not empty, a coverage profile is written to that file.
+// It uses both master and temporary GOPATHs. The results of
+// the tests are added to the report and returned. Tests run
+// arbitrary code, so they should be isolated with a Sandbox.
+func (be BuildEnv) goTest(pkg, coverProfile string) ([]TestResult, error) {
 	// Note that we run tests on ./... and change the cwd of
 	// the command to the package in the temporary GOPATH.
 	// This is because specifying the package name instead of
@@ -191,21 +275,23 @@ func (be BuildEnv) goTest(pkg string) error {
 	// `mkdir -p $WORK/github.com/user/repo/folder/that/doesn't/
 	// exist/in/temp/gopath/_test/github.com/user/repo/same/folder/
 	// -- very unexpected!)
-	cmd := be.newCommand("go", "test", "-race", "./...")
-	cmd.Dir = be.TemporaryPath(pkg)
-	return be.runCommand(cmd)
+	var args []string
+	if coverProfile != "" {
+		args = append(args, "-coverprofile", coverProfile)
+	}
+	return be.runGoTest(be.TemporaryPath(pkg), testSource(pkg), 0, append(args, "./...")...)
 }
 
 // gitCheckout runs `git checkout $version` from the directory repoPath.
 func (be BuildEnv) gitCheckout(repoPath, version string) error {
-	cmd := be.newCommand("git", "checkout", version)
+	cmd := be.newCommand(classLocal, "git", "checkout", version)
 	cmd.Dir = repoPath
 	return be.runCommand(cmd)
 }
 
 // gitFetch runs `git fetch` in the directory repoPath.
 func (be BuildEnv) gitFetch(repoPath string) error {
-	cmd := be.newCommand("git", "fetch")
+	cmd := be.newCommand(classNetwork, "git", "fetch")
 	cmd.Dir = repoPath
 	return be.runCommand(cmd)
 }
@@ -217,7 +303,17 @@ func (be BuildEnv) gitFetch(repoPath string) error {
 func (be BuildEnv) fillMasterGopath() error {
 	lock(be.masterGopath)
 	defer unlock(be.masterGopath)
+	master := be.asMaster()
 	for pkg := range be.pkgs {
+		// plugins with their own clone URL can't be
+		// downloaded by `go get` from their import path
+		if url, ok := be.repos[pkg]; ok {
+			err := be.cloneMasterRepo(pkg, url)
+			if err != nil {
+				return err
+			}
+		}
+
 		if pkg == CaddyPackage {
 			// the caddy package is a special case because of its
 			// plugin architecture and the fact that it's the package
@@ -226,7 +322,7 @@ func (be BuildEnv) fillMasterGopath() error {
 			pkg += "/..."
 		}
 
-		cmd := be.newCommand("go", "get", "-d", "-t", "-x", pkg)
+		cmd := master.newCommand(classNetwork, "go", "get", "-d", "-t", "-x", pkg)
 		setEnvGopath(cmd.Env, be.masterGopath)
 		err := be.runCommand(cmd)
 		if err != nil {
@@ -236,11 +332,63 @@ func (be BuildEnv) fillMasterGopath() error {
 	return nil
 }
 
-// Close deletes the temporary GOPATH from disk.
+// Close kills any processes left running by the
+// commands of this build environment if it has its
+// own uid, unmounts anything mounted in it, and
+// deletes the temporary GOPATH from disk.
 func (be BuildEnv) Close() error {
+	if be.releaseDir != nil {
+		defer be.releaseDir()
+	}
+	if UidRange != "" {
+		err := killUidProcesses(be.uid)
+		if err != nil {
+			// don't let another build environment
+			// use the uid while they're still around
+			if be.unmountAll() == nil {
+				be.releaseShared()
+				os.RemoveAll(be.tmpGopath)
+			}
+			return fmt.Errorf("killing leftover processes: %v", err)
+		}
+		defer releaseUid(be.uid)
+	}
+	err := be.unmountAll()
+	if err != nil {
+		// don't remove anything through the mounts
+		return err
+	}
+	be.releaseShared()
 	return os.RemoveAll(be.tmpGopath)
 }
 
+// asMaster returns a copy of be whose commands run as
+// the owner of the master GOPATH (UidGid) instead of
+// the uid of be. It must be used for commands that
+// change the master GOPATH.
+func (be BuildEnv) asMaster() BuildEnv {
+	be.uid = UidGid
+	return be
+}
+
+// newMasterEnv returns a build environment without a
+// temporary GOPATH, for working on the master GOPATH
+// (from environment) itself.
+func newMasterEnv() (BuildEnv, error) {
+	masterGopath := os.Getenv("GOPATH")
+	if masterGopath == "" {
+		return BuildEnv{}, fmt.Errorf("no master GOPATH")
+	}
+	logBuf := new(bytes.Buffer)
+	return BuildEnv{
+		masterGopath: masterGopath,
+		uid:          UidGid,
+		Log:          logBuf,
+		log:          log.New(logBuf, "", log.Ldate|log.Ltime),
+		Report:       new(Report),
+	}, nil
+}
+
 // TemporaryPath returns the path to pkg's source
 // folder in the temporary GOPATH.
 func (be BuildEnv) TemporaryPath(pkg string) string {
@@ -278,15 +426,16 @@ func (be BuildEnv) RepoPath(pkg string) string {
 }
 
 // newTemporaryGopath creates a new gopath folder
-// in a temporary location. It is the caller's
-// responsibility to remove the gopath when finished.
-func newTemporaryGopath() (string, error) {
+// in a temporary location, owned by uid. It is the
+// caller's responsibility to remove the gopath when
+// finished.
+func newTemporaryGopath(uid int) (string, error) {
 	ts := time.Now().Format(MonthDayHourMin)
 	tmp, err := ioutil.TempDir("", fmt.Sprintf("gopath_%s.", ts))
 	if err != nil {
 		return tmp, err
 	}
-	return tmp, chown(tmp)
+	return tmp, chown(tmp, uid)
 }
 
 // setEnvGopath sets the GOPATH variable in env
@@ -304,7 +453,10 @@ func setEnvGopath(env []string, to string) {
 // build environment. It sets a custom environment, including
 // a GOPATH variable that uses *both* the master and temporary
 // GOPATHs. If this command should only use one GOPATH, be sure
-// to call setEnvGopath() to change it.
+// to call setEnvGopath() to change it. The class of the command
+// determines how it is isolated if a Sandbox is enabled, and
+// whether it gets the credentials for private repositories
+// (only classNetwork commands do; see LoadCredentials).
 //
 // If Chroot is enabled, the Dir field on the returned Cmd will
 // be set to "/" which guarantees that the command will run from
@@ -313,36 +465,96 @@ func setEnvGopath(env []string, to string) {
 // will not be set. If you need to run the command from a
 // certain directory, you can certainly change the value of the
 // Dir field.
-func (be BuildEnv) newCommand(command string, args ...string) *exec.Cmd {
+func (be BuildEnv) newCommand(class commandClass, command string, args ...string) *exec.Cmd {
 	cmd := exec.Command(command, args...)
-	cmd.Env = []string{
-		"GOPATH=" + be.tmpGopath + ":" + be.masterGopath,
-		"PATH=" + os.Getenv("PATH"),
-		"TMPDIR=" + os.Getenv("TMPDIR"),
+	cmd.Env = be.commandEnv()
+	if class == classNetwork {
+		cmd.Env = append(cmd.Env, loadedCredentials.env...)
 	}
 	cmd.Stdout = be.Log
 	cmd.Stderr = be.Log
+	if Sandbox == SandboxNamespaces || Hardening != "" {
+		be.sandboxCommand(cmd, class)
+		return cmd
+	}
 	if Chroot != "" {
 		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: Chroot}
 		cmd.Dir = "/" // should have no effect on "go get" (for example), but needed for "go get" if chroot'ed
 	}
-	if UidGid > -1 {
+	if be.uid > -1 {
 		if cmd.SysProcAttr == nil {
 			cmd.SysProcAttr = new(syscall.SysProcAttr)
 		}
 		cmd.SysProcAttr.Credential = &syscall.Credential{
-			Uid: uint32(UidGid),
-			Gid: uint32(UidGid),
+			Uid: uint32(be.uid),
+			Gid: uint32(be.uid),
 		}
 		cmd.SysProcAttr.Setsid = true
 	}
 	return cmd
 }
 
+// commandEnv returns the environment that commands
+// related to this build environment run with. Commands
+// do not inherit the environment of this process, except
+// for PATH and TMPDIR. GOPATH is set to use both the
+// temporary and master GOPATHs, in that order.
+func (be BuildEnv) commandEnv() []string {
+	return []string{
+		"GOPATH=" + be.tmpGopath + ":" + be.masterGopath,
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.Getenv("TMPDIR"),
+	}
+}
+
+// hostPath returns the path on the host of path as seen by
+// commands. With Chroot, only the master GOPATH and the
+// temporary directory are at the same paths in the jail
+// (see InitJail); everything else, like the toolchain
+// and its standard library, is in the jail.
+func (be BuildEnv) hostPath(path string) string {
+	if Chroot == "" || Sandbox == SandboxNamespaces || path == "" {
+		return path
+	}
+	for _, same := range []string{be.masterGopath, os.TempDir()} {
+		if path == same || strings.HasPrefix(path, same+string(filepath.Separator)) {
+			return path
+		}
+	}
+	return filepath.Join(Chroot, path)
+}
+
 // runCommand runs cmd while logging the command being run.
+// The resources it used are added to the report (see
+// beginPhase for how the temporary GOPATH is measured). If
+// the temporary GOPATH exceeds the DiskQuota while the
+// command runs, the command is killed; if it is found to
+// exceed it before the command runs, an error is returned.
 func (be BuildEnv) runCommand(cmd *exec.Cmd) error {
-	be.log.Printf("exec [%s] %s %s\n", cmd.Dir, cmd.Path, strings.Join(cmd.Args[1:], " "))
-	return cmd.Run()
+	path, args := cmd.Path, cmd.Args[1:]
+	if cmd.Args[0] == sandboxArg0 {
+		path, args = cmd.Args[1], cmd.Args[2:]
+	}
+	be.log.Printf("exec [%s] %s %s\n", cmd.Dir, path, strings.Join(args, " "))
+	phase := commandPhase(path, args)
+	err := be.beginPhase(phase)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = cmd.Start()
+	exceeded := false
+	if err == nil {
+		stop := be.watchDiskQuota(cmd)
+		err = cmd.Wait()
+		exceeded = stop()
+	}
+	be.gopathChanged()
+	be.recordUsage(phase, time.Since(start), cmd.ProcessState)
+	if exceeded {
+		err = fmt.Errorf("killed when the temporary GOPATH grew beyond %d bytes: %v", DiskQuota, errDiskQuota)
+	}
+	return err
 }
 
 // Deploy deploys the package that the BuildEnv was
@@ -357,33 +569,35 @@ func (be BuildEnv) runCommand(cmd *exec.Cmd) error {
 // An error is returned if anything failed, in which case
 // you should consider the deployment/release a failure.
 func (be BuildEnv) Deploy(requiredPlatforms []Platform) error {
-	// we only allow deploying caddy itself or
-	// a single plugin at a time.
-	switch len(be.pkgs) {
-	case 0:
-		return fmt.Errorf("nothing to deploy")
-	case 1, 2:
-		if _, ok := be.pkgs[CaddyPackage]; !ok {
-			return fmt.Errorf("no caddy package")
-		}
-	default:
-		return fmt.Errorf("too many packages to deploy")
+	defer be.endPhase() // see gopathUsage
+	err := be.checkDeployable()
+	if err != nil {
+		return err
 	}
 
-	// backup the master GOPATH in case something
-	// goes really wrong (like, if a dependency we
-	// aren't tracking gets updated and breaks caddy,
-	// that would be bad; we assume the current
-	// GOPATH is at least mostly healthy)
-	backupGopath, err := be.backupMasterGopath()
+	// take a snapshot of the master GOPATH in case
+	// something goes really wrong (like, if a dependency
+	// we aren't tracking gets updated and breaks caddy,
+	// that would be bad; we assume the current GOPATH
+	// is at least mostly healthy)
+	pkg := be.packageToDeploy()
+	snap, err := be.takeSnapshot(pkg + "@" + be.pkgs[pkg])
 	if err != nil {
-		return err
+		return fmt.Errorf("taking snapshot of master GOPATH: %v", err)
 	}
-	defer os.RemoveAll(backupGopath)
 
 	// run `go get -u` in master GOPATH only, so that
 	// dependencies get updated -- crossing fingers!
 	err = be.UpdateMasterGopath()
+
+	// report which dependencies moved, even if the
+	// update failed part of the way through
+	after, err2 := be.repoCommits()
+	if err2 != nil {
+		be.log.Printf("recording commits after update: %v", err2)
+	} else {
+		be.Report.Changes = be.describeChanges(diffCommits(snap.commits(), after))
+	}
 	if err != nil {
 		return err
 	}
@@ -397,120 +611,43 @@ func (be BuildEnv) Deploy(requiredPlatforms []Platform) error {
 		// tends to catch most of its bugs. the test failures
 		// might be caused because of `go get -u`, so our only
 		// hope is to restore the GOPATH to before the update.
-		err2 := be.restoreMasterGopath(backupGopath)
+		err2 := be.restoreSnapshot(snap.ID)
 		if err2 != nil {
-			// well, this is terrible. we now have multiple
-			// GOPATHs that don't work. just cry.
-			return fmt.Errorf("%v; additionally, error restoring GOPATH: %v", err, err2)
+			// well, this is terrible. the master GOPATH is
+			// partly restored; the snapshot is still there,
+			// so restoring it can be tried again. just cry.
+			return fmt.Errorf("%v; additionally, error restoring GOPATH to snapshot %s: %v", err, snap.ID, err2)
 		}
 	}
-
-	return err
-}
-
-// backupMasterGopath copies the src directory of the master
-// GOPATH of the build environment to a temporary location and
-// returns that location. It is the caller's responsibility to
-// delete it when no longer needed. If an error is returned, no
-// need to clean up.
-func (be BuildEnv) backupMasterGopath() (string, error) {
-	rlock(be.masterGopath)
-	defer runlock(be.masterGopath)
-
-	// only back up the src directory; we don't want to mess
-	// with the top-level GOPATH folder in case it is being
-	// linked to or bind mounted, etc.
-	src := filepath.Join(be.masterGopath, "src")
-
-	// make temporary folder to hold the backup
-	tmpdir, err := ioutil.TempDir("", "src_backup_")
 	if err != nil {
-		return tmpdir, fmt.Errorf("getting temporary directory for GOPATH src backup: %v", err)
+		return err
 	}
 
-	// As of Go 1.8, Go sets the permissions on a temporary directory
-	// to 0700, but we should preserve the permissions in case we need
-	// to restore it, since the copy will replicate the permissions too.
-	srcInfo, err := os.Stat(src)
+	// pin what was deployed, so that builds can ask for it
+	lf, err := be.writeLockFile(snap.Deploy)
 	if err != nil {
-		return tmpdir, fmt.Errorf("stat master GOPATH src: %v", err)
-	}
-	err = os.Chmod(tmpdir, srcInfo.Mode())
-	if err != nil {
-		return tmpdir, fmt.Errorf("chmod temporary backup GOPATH src: %v", err)
-	}
-	statT := srcInfo.Sys().(*syscall.Stat_t)
-	err = os.Chown(tmpdir, int(statT.Uid), int(statT.Gid))
-	if err != nil {
-		return tmpdir, fmt.Errorf("chown temporary backup GOPATH src: %v", err)
+		return fmt.Errorf("writing lock file: %v", err)
 	}
+	be.log.Printf("wrote lock file %s", lf.ID)
+	be.Report.LockFile = lf.ID
 
-	// then do the actual deep copy; we only need the src folder
-	// since pkg and bin can be re-created if necessary (unlikely)
-	err = deepCopy(deepCopyConfig{
-		Source:        src,
-		Dest:          tmpdir,
-		SkipSymLinks:  true,
-		PreserveOwner: true,
-	})
-	if err != nil {
-		os.RemoveAll(tmpdir)
-	}
-	return tmpdir, err
+	return nil
 }
 
-// restoreMasterGopath copies the backup GOPATH src folder
-// at backupDir back into the build environment's master GOPATH's
-// src folder; it fully replaces the existing master GOPATH's
-// src folder with the contents of the backup but does not
-// change the path of the master GOPATH or its src folder. An
-// error returned from this function is awful, sorry. This
-// function does NOT clean up the backupDir that is passed in.
-func (be BuildEnv) restoreMasterGopath(backupDir string) error {
-	lock(be.masterGopath)
-	defer unlock(be.masterGopath)
-
-	// only restore the src folder! because we move/rename
-	// this top level folder, we do not want to do that to
-	// the top GOPATH folder because it may be mounted or
-	// linked to and renaming it breaks things; but we should
-	// be able to move/rename the src subfolder alright.
-	dest := filepath.Join(be.masterGopath, "src")
-
-	// rename the master src folder so we have a clean
-	// destination to copy into; safer than deleting
-	// our master copy before the restore is successful
-	// (this DOES break any bind mounts or links that
-	// point to it!)
-	suffix := fmt.Sprintf("%d", rand.Intn(90000)+10000)
-	tmpPath := dest + "_tmp_" + suffix
-	err := os.Rename(dest, tmpPath)
-	if err != nil {
-		return err
-	}
-
-	// copy the files back over
-	err = deepCopy(deepCopyConfig{
-		Source:        backupDir,
-		Dest:          dest,
-		SkipSymLinks:  true,
-		PreserveOwner: true,
-	})
-	if err != nil {
-		return fmt.Errorf("copy for restoring master GOPATH src: %v; old master src left intact: %s", err, tmpPath)
-	}
-
-	// copy successful, so clean up by deleting the original GOPATH
-	err = os.RemoveAll(tmpPath)
-	if err != nil {
-		return err
+// checkDeployable returns an error if the build
+// environment cannot be deployed: we only allow
+// deploying caddy itself or a single plugin at a time.
+func (be BuildEnv) checkDeployable() error {
+	switch len(be.pkgs) {
+	case 0:
+		return fmt.Errorf("nothing to deploy")
+	case 1, 2:
+		if _, ok := be.pkgs[CaddyPackage]; !ok {
+			return fmt.Errorf("no caddy package")
+		}
+	default:
+		return fmt.Errorf("too many packages to deploy")
 	}
-
-	// also delete pkg and bin directories that were there;
-	// they can be remade and may be stale
-	os.RemoveAll(filepath.Join(be.masterGopath, "pkg"))
-	os.RemoveAll(filepath.Join(be.masterGopath, "bin"))
-
 	return nil
 }
 
@@ -559,13 +696,37 @@ func (be BuildEnv) packageToDeploy() string {
 // version will not be affected.
 func (be BuildEnv) UpdateMasterGopath() error {
 	pkg := be.packageToDeploy()
+	master := be.asMaster()
+	lock(be.masterGopath)
+	defer unlock(be.masterGopath)
+
+	args := []string{"get", "-u", "-d", "-t", "-x"}
+	if url, ok := be.repos[pkg]; ok {
+		// deploying a plugin from its own clone URL makes
+		// the master GOPATH track that URL from now on
+		// (until it is reverted to a snapshot from before,
+		// which records the old origin); -f keeps `go get`
+		// from insisting on the import path
+		repoPath := be.RepoPath(pkg)
+		old, err := be.gitOutput(repoPath, "config", "--get", "remote.origin.url")
+		if err == nil && old != url {
+			be.log.Printf("changing origin of %s from %s to %s", pkg, old, url)
+			if be.Report.PreviousOrigins == nil {
+				be.Report.PreviousOrigins = make(map[string]string)
+			}
+			be.Report.PreviousOrigins[be.repoOf(pkg)] = old
+		}
+		err = master.setOrigin(repoPath, url)
+		if err != nil {
+			return fmt.Errorf("setting origin of %s to %s: %v", pkg, url, err)
+		}
+		args = append(args, "-f")
+	}
 	if pkg == CaddyPackage {
 		pkg += "/..." // see fillMasterGopath() for why we do this
 	}
-	cmd := be.newCommand("go", "get", "-u", "-d", "-t", "-x", pkg)
+	cmd := master.newCommand(classNetwork, "go", append(args, pkg)...)
 	setEnvGopath(cmd.Env, be.masterGopath) // operate on master GOPATH only
-	lock(be.masterGopath)
-	defer unlock(be.masterGopath)
 	be.log.Printf("Updating master GOPATH: %s", be.masterGopath)
 	return be.runCommand(cmd)
 }
@@ -594,12 +755,50 @@ func (be BuildEnv) RunPluginChecks(requiredPlatforms []Platform) (bool, error) {
 			return false, fmt.Errorf("go vet plugin %s: %v", pkg, err)
 		}
 
+		// run our own static analysis of the plugin
+		diags, err := be.staticCheck(pkg)
+		if err != nil {
+			return false, fmt.Errorf("static analysis of plugin %s: %v", pkg, err)
+		}
+		if len(diags) > 0 {
+			return false, fmt.Errorf("static analysis of plugin %s: %d problem(s) found", pkg, len(diags))
+		}
+
 		// go test the plugin
-		err = be.goTest(pkg)
+		var coverProfile string
+		if MeasureCoverage {
+			coverProfile = filepath.Join(be.tmpGopath, "coverage.out")
+		}
+		err = be.goTestWithRetries(pkg, coverProfile)
 		if err != nil {
 			return false, fmt.Errorf("go test plugin %s: %v", pkg, err)
 		}
 
+		// see how much of the plugin was covered
+		if MeasureCoverage {
+			cov, err := parseCoverProfile(coverProfile)
+			if err != nil {
+				return false, fmt.Errorf("reading coverage profile of plugin %s: %v", pkg, err)
+			}
+			be.log.Printf("%s test coverage: %.1f%% of statements", pkg, cov.Total)
+			if be.Report.Coverage == nil {
+				be.Report.Coverage = make(map[string]Coverage)
+			}
+			be.Report.Coverage[pkg] = cov
+			if cov.Total < MinCoverage {
+				return false, fmt.Errorf("test coverage of plugin %s is %.1f%%, below the minimum of %.1f%%",
+					pkg, cov.Total, MinCoverage)
+			}
+		}
+
+		// see what is registered with Caddy before the
+		// plugin is plugged in, so we can tell what the
+		// plugin registers when it is
+		before, err := be.registeredPlugins()
+		if err != nil {
+			return false, fmt.Errorf("probing registered plugins: %v", err)
+		}
+
 		// plug in the plugin
 		// TODO: This does not unplug any previously-plugged-in
 		// plugins, but that's okay since we only deploy one
@@ -610,8 +809,38 @@ func (be BuildEnv) RunPluginChecks(requiredPlatforms []Platform) (bool, error) {
 			return false, fmt.Errorf("plugging in %s: %v", pkg, err)
 		}
 
+		// a plugin that compiles but registers nothing
+		// is not a plugin at all
+		after, err := be.registeredPlugins()
+		if err != nil {
+			return false, fmt.Errorf("probing registered plugins with %s plugged in: %v", pkg, err)
+		}
+		var added []string
+		if before != nil && after != nil {
+			added = pluginsAdded(before, after)
+			if len(added) == 0 {
+				return false, fmt.Errorf("plugin %s does not register anything with Caddy", pkg)
+			}
+		} else {
+			// settle for the names we can find in the source
+			added, err = pluginNames(be.TemporaryPath(pkg))
+			if err != nil {
+				return false, fmt.Errorf("finding names of plugin %s: %v", pkg, err)
+			}
+		}
+		if len(added) == 0 {
+			// this version of caddy cannot list its plugins,
+			// so nothing can vouch for the plugin either
+			return false, fmt.Errorf("plugin %s does not register anything with Caddy that could be found in its source", pkg)
+		}
+		be.log.Printf("%s registered: %s", pkg, strings.Join(added, ", "))
+		if be.Report.Registered == nil {
+			be.Report.Registered = make(map[string][]string)
+		}
+		be.Report.Registered[pkg] = added
+
 		// go test Caddy with the plugin installed
-		err = be.goTest(CaddyPackage)
+		err = be.goTestWithRetries(CaddyPackage, "")
 		if err != nil {
 			return true, fmt.Errorf("go test caddy with plugin: %v", err)
 		}
@@ -635,7 +864,7 @@ func (be BuildEnv) RunCaddyChecks() error {
 	}
 
 	// go test
-	err = be.goTest(CaddyPackage)
+	err = be.goTestWithRetries(CaddyPackage, "")
 	if err != nil {
 		return fmt.Errorf("go test: %v", err)
 	}
@@ -661,6 +890,7 @@ func (be BuildEnv) RunCaddyChecks() error {
 // build environment and bundling all distribution assets into an
 // archive file with the binary.
 func (be BuildEnv) Build(plat Platform, outputFolder string) (*os.File, error) {
+	defer be.endPhase() // see gopathUsage
 	if plat.OS == "" || plat.Arch == "" {
 		return nil, fmt.Errorf("missing required information: OS or arch")
 	}
@@ -672,11 +902,34 @@ func (be BuildEnv) Build(plat Platform, outputFolder string) (*os.File, error) {
 	}
 	binaryOutputPath := filepath.Join(outputFolder, binaryOutputName)
 
-	// perform build
-	err := be.buildCaddy(plat, binaryOutputPath)
+	// perform build; the binary is built (and smoke tested)
+	// in the temporary GOPATH, since that is where commands
+	// can write to, then moved to the output folder
+	binaryBuildPath := filepath.Join(be.tmpGopath, "bin", binaryOutputName)
+	ldvars, err := be.buildCaddy(plat, binaryBuildPath)
 	if err != nil {
 		return nil, fmt.Errorf("building caddy: %v", err)
 	}
+
+	// make sure the binary actually runs, if we can
+	if SmokeTest && plat.OS == runtime.GOOS && plat.Arch == runtime.GOARCH {
+		err = be.smokeTest(binaryBuildPath, ldvars)
+		if err != nil {
+			return nil, fmt.Errorf("smoke test: %v", err)
+		}
+	}
+
+	err = os.Rename(binaryBuildPath, binaryOutputPath)
+	if err != nil {
+		// the output folder may be on another file system
+		err = copyPlainFile(binaryBuildPath, binaryOutputPath)
+		if err == nil {
+			err = os.Remove(binaryBuildPath)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("moving binary to output folder: %v", err)
+	}
 	defer os.Remove(binaryOutputPath)
 
 	// choose .tar.gz or .zip format depending on OS
@@ -719,6 +972,13 @@ func (be BuildEnv) Build(plat Platform, outputFolder string) (*os.File, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error compressing: %v", err)
 	}
+	if DiskQuota > 0 {
+		used := dirSize(be.tmpGopath) + dirSize(outputFolder)
+		if used > DiskQuota {
+			os.Remove(finalOutputPath)
+			return nil, fmt.Errorf("build uses %d bytes: %v", used, errDiskQuota)
+		}
+	}
 
 	// return opened archive so it can be read immediately
 	return os.Open(finalOutputPath)
@@ -740,19 +1000,25 @@ func (be BuildEnv) plugInThePlugin(pkg string) error {
 	if err != nil {
 		return fmt.Errorf("adding import: %v", err)
 	}
-	// TODO: Use file mode as already on disk
+	// the file may be shared with the master GOPATH (see
+	// ProvisionStrategy), so replace it instead of writing
+	// to it; TODO: Use file mode as already on disk
+	err = os.Remove(file)
+	if err != nil {
+		return fmt.Errorf("removing original file: %v", err)
+	}
 	err = ioutil.WriteFile(file, buf.Bytes(), os.FileMode(0660))
 	if err != nil {
 		return fmt.Errorf("saving changed file: %v", err)
 	}
-	return nil
+	return chown(file, be.uid)
 }
 
 // goBuildChecks cross-compiles pkg for all requiredPlatforms.
 func (be BuildEnv) goBuildChecks(pkg string, requiredPlatforms []Platform) error {
 	for _, platform := range requiredPlatforms {
 		be.log.Printf("GOOS=%s GOARCH=%s GOARM=%s go build", platform.OS, platform.Arch, platform.ARM)
-		cmd := be.newCommand("go", "build", "-p", strconv.Itoa(ParallelBuildOps), pkg+"/...")
+		cmd := be.newCommand(classLocal, "go", "build", "-p", strconv.Itoa(ParallelBuildOps), pkg+"/...")
 		for _, env := range []string{
 			"CGO_ENABLED=0",
 			"GOOS=" + platform.OS,
@@ -775,16 +1041,17 @@ func (be BuildEnv) goBuildChecks(pkg string, requiredPlatforms []Platform) error
 // binary at outputFile. As part of the build process, the plugins
 // specified in the BuildEnv will be plugged in. The outputFile
 // path will be relative to the folder where Caddy's main()
-// function is defined (or it can be an absolute path).
-func (be BuildEnv) buildCaddy(plat Platform, outputFile string) error {
+// function is defined (or it can be an absolute path). It returns
+// the values of the variables that were set with ldflags.
+func (be BuildEnv) buildCaddy(plat Platform, outputFile string) (map[string]string, error) {
 	// make ldflags before plugging in the plugins; changing the source
 	// file(s) affects the result of the ldflags which are designed to
 	// record any changes to the source code, but we want caddy that
 	// comes from the build server to have a clean version even with
 	// plugins plugged in.
-	ldflags, err := makeLdFlags(be.TemporaryPath(CaddyPackage))
+	ldflags, ldvars, err := makeLdFlags(be.TemporaryPath(CaddyPackage))
 	if err != nil {
-		return fmt.Errorf("making ldflags: %v", err)
+		return nil, fmt.Errorf("making ldflags: %v", err)
 	}
 
 	// plug in the plugins
@@ -794,7 +1061,7 @@ func (be BuildEnv) buildCaddy(plat Platform, outputFile string) error {
 		}
 		err := be.plugInThePlugin(pkg)
 		if err != nil {
-			return fmt.Errorf("plugging in %s: %v", pkg, err)
+			return nil, fmt.Errorf("plugging in %s: %v", pkg, err)
 		}
 	}
 
@@ -802,7 +1069,7 @@ func (be BuildEnv) buildCaddy(plat Platform, outputFile string) error {
 	args := []string{"build", "-ldflags", ldflags, "-o", outputFile}
 	args = append(args, "-asmflags", fmt.Sprintf("-trimpath=%s", be.tmpGopath))
 	args = append(args, "-gcflags", fmt.Sprintf("-trimpath=%s", be.tmpGopath))
-	cmd := be.newCommand("go", args...)
+	cmd := be.newCommand(classLocal, "go", args...)
 	cmd.Dir = filepath.Join(be.TemporaryPath(CaddyPackage), "caddy") // main() func is in this subfolder
 	for _, env := range []string{
 		"CGO_ENABLED=0",
@@ -812,7 +1079,92 @@ func (be BuildEnv) buildCaddy(plat Platform, outputFile string) error {
 	} {
 		cmd.Env = append(cmd.Env, env)
 	}
-	return be.runCommand(cmd)
+	return ldvars, be.runCommand(cmd)
+}
+
+// smokeTest runs the caddy binary at binaryPath (which must
+// have been built for this platform) with -version and -plugins
+// to make sure that it runs, that its version is what was set
+// by the ldflags (ldvars), and that every plugin in this build
+// environment is in it. The binary is run like any other
+// command, so it is subject to the same jail and privileges.
+func (be BuildEnv) smokeTest(binaryPath string, ldvars map[string]string) error {
+	run := func(flag string) (string, error) {
+		var out bytes.Buffer
+		cmd := be.newCommand(classUntrusted, binaryPath, flag)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := be.runCommand(cmd)
+		be.log.Printf("caddy %s output: %s", flag, out.String())
+		if err != nil {
+			return "", fmt.Errorf("caddy %s: %v: %s", flag, err, out.String())
+		}
+		return out.String(), nil
+	}
+
+	// check version
+	versionOut, err := run("-version")
+	if err != nil {
+		return err
+	}
+	expected := expectedVersion(ldvars)
+	if !strings.Contains(versionOut, expected) {
+		return fmt.Errorf("version output does not contain %s: %s", expected, versionOut)
+	}
+
+	// check plugins
+	pluginsOut, err := run("-plugins")
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(pluginsOut, "\n") {
+		name := strings.TrimSpace(line)
+		listed[name] = true
+		if dot := strings.Index(name, "."); dot > -1 {
+			listed[name[dot+1:]] = true // without server type
+		}
+	}
+	for pkg := range be.pkgs {
+		if pkg == CaddyPackage {
+			continue
+		}
+		names, err := pluginNames(be.TemporaryPath(pkg))
+		if err != nil {
+			return fmt.Errorf("finding names of plugin %s: %v", pkg, err)
+		}
+		if len(names) == 0 {
+			be.log.Printf("could not determine names registered by %s; not checking that it is plugged in", pkg)
+			continue
+		}
+		for _, name := range names {
+			if !listed[name] {
+				return fmt.Errorf("plugin %s (%s) is not listed by caddy -plugins: %s", name, pkg, pluginsOut)
+			}
+		}
+	}
+
+	return nil
+}
+
+// expectedVersion returns what the output of `caddy -version`
+// must contain for a binary built with ldvars, by the same
+// rules as setVersion() in caddymain: a development build (not
+// at a tag, or with uncommitted changes) shows the nearest tag
+// and the commit, if there is a nearest tag; otherwise it shows
+// the tag, if there is one. Without either, Caddy does not know
+// its version.
+func expectedVersion(ldvars map[string]string) string {
+	tag, nearestTag := ldvars["gitTag"], ldvars["gitNearestTag"]
+	devBuild := tag == "" || ldvars["gitShortStat"] != ""
+	switch {
+	case devBuild && nearestTag != "":
+		return strings.TrimPrefix(nearestTag, "v") + " (+" + ldvars["gitCommit"]
+	case tag != "":
+		return strings.TrimPrefix(tag, "v")
+	default:
+		return "(untracked dev build)"
+	}
 }
 
 // Platform contains information about platforms. The values of
@@ -894,12 +1246,12 @@ func SupportedPlatforms(skip []Platform) ([]Platform, error) {
 	return platforms, nil
 }
 
-// chown runs os.Chown on file to UidGid if
-// UidGid is set to a value greater than -1.
+// chown runs os.Chown on file to uid (and the gid
+// with the same number) if uid is greater than -1.
 // It does nothing otherwise.
-func chown(file string) error {
-	if UidGid > -1 {
-		return os.Chown(file, UidGid, UidGid)
+func chown(file string, uid int) error {
+	if uid > -1 {
+		return os.Chown(file, uid, uid)
 	}
 	return nil
 }
@@ -914,7 +1266,9 @@ var (
 	// UidGid is the uid and gid to run commands as
 	// and to set file ownership to. A value of -1
 	// will cause no changes in ownership or the
-	// uid/gid of commands.
+	// uid/gid of commands. If UidRange is set, it is
+	// only used for commands that change the master
+	// GOPATH.
 	UidGid = -1
 
 	// Chroot is the directory to in which to jail
@@ -922,6 +1276,11 @@ var (
 	Chroot string
 )
 
+// SmokeTest enables running builds of Caddy that are
+// for the same platform as this one before returning
+// them, to make sure the binary works as expected.
+var SmokeTest bool
+
 const (
 	// MonthDayHourMin is the date format used in
 	// some temporary file paths
@@ -0,0 +1,46 @@
+package buildworker
+
+import "testing"
+
+func TestExpectedVersion(t *testing.T) {
+	for i, test := range []struct {
+		ldvars map[string]string
+		expect string
+	}{
+		{
+			ldvars: map[string]string{"gitTag": "v0.10.3", "gitNearestTag": "v0.10.3", "gitCommit": "abc1234"},
+			expect: "0.10.3",
+		},
+		{
+			ldvars: map[string]string{"gitNearestTag": "v0.10.3", "gitCommit": "abc1234"},
+			expect: "0.10.3 (+abc1234",
+		},
+		{
+			ldvars: map[string]string{"gitTag": "v0.10.3", "gitNearestTag": "v0.10.3", "gitCommit": "abc1234",
+				"gitShortStat": "1 file changed, 2 insertions(+)", "gitFilesModified": "caddy.go"},
+			expect: "0.10.3 (+abc1234",
+		},
+		{
+			// modified files alone do not make a development build
+			ldvars: map[string]string{"gitTag": "v0.10.3", "gitNearestTag": "v0.10.3", "gitCommit": "abc1234",
+				"gitFilesModified": "caddy.go"},
+			expect: "0.10.3",
+		},
+		{
+			ldvars: map[string]string{"gitTag": "v0.10.3", "gitCommit": "abc1234", "gitShortStat": "1 file changed"},
+			expect: "0.10.3",
+		},
+		{
+			ldvars: map[string]string{"gitCommit": "abc1234"},
+			expect: "(untracked dev build)",
+		},
+		{
+			ldvars: nil,
+			expect: "(untracked dev build)",
+		},
+	} {
+		if actual := expectedVersion(test.ldvars); actual != test.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expect, actual)
+		}
+	}
+}
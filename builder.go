@@ -2,6 +2,7 @@ package buildworker
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
@@ -20,9 +21,6 @@ import (
 // Its private key must be decrypted.
 var Signer *openpgp.Entity
 
-// TODO: Maintain master gopath (when? master gopaths are
-// scoped to individual BuildEnvs) by pruning unused packages...
-
 var gopathLocks = make(map[string]*sync.RWMutex)
 
 func lock(gopath string) {
@@ -51,7 +49,7 @@ func runlock(gopath string) {
 type CaddyPlugin struct {
 	Package string `json:"package"` // fully qualified package import path
 	Version string `json:"version"` // commit, tag, or branch to checkout
-	Repo    string `json:"repo"`    // git clone URL -- TODO: used?
+	Repo    string `json:"repo"`    // git clone URL, if not the import path (like a fork)
 	Name    string `json:"-"`       // name of plugin: not used here, but used by devportal
 	ID      string `json:"-"`       // ID of plugin: not used here, but used by devportal
 }
@@ -61,14 +59,16 @@ type CaddyPlugin struct {
 type BuildConfig struct {
 	CaddyVersion string        `json:"caddy_version"`
 	Plugins      []CaddyPlugin `json:"plugins"`
+	LockFile     string        `json:"lock_file,omitempty"` // ID of a lock file to pin dependencies to
 }
 
 const ldFlagVarPkg = "github.com/mholt/caddy/caddy/caddymain"
 
 // makeLdFlags makes a string to pass in as ldflags when building Caddy.
 // This automates proper versioning, so it uses git to get information
-// about the current version of Caddy.
-func makeLdFlags(repoPath string) (string, error) {
+// about the current version of Caddy. It also returns the values of
+// the variables that are set by the ldflags, keyed by variable name.
+func makeLdFlags(repoPath string) (string, map[string]string, error) {
 	run := func(cmd *exec.Cmd, ignoreError bool) (string, error) {
 		cmd.Dir = repoPath
 		out, err := cmd.Output()
@@ -79,6 +79,7 @@ func makeLdFlags(repoPath string) (string, error) {
 	}
 
 	var ldflags []string
+	values := make(map[string]string)
 
 	for _, ldvar := range []struct {
 		name  string
@@ -135,12 +136,13 @@ func makeLdFlags(repoPath string) (string, error) {
 	} {
 		value, err := ldvar.value()
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 		ldflags = append(ldflags, fmt.Sprintf(`-X "%s.%s=%s"`, ldFlagVarPkg, ldvar.name, value))
+		values[ldvar.name] = value
 	}
 
-	return strings.Join(ldflags, " "), nil
+	return strings.Join(ldflags, " "), values, nil
 }
 
 // dirExists returns true if dir exists and is a
@@ -153,20 +155,89 @@ func dirExists(dir string) bool {
 	return info.IsDir()
 }
 
-// deepCopyConfig configures a deep copy.
+// deepCopyConfig configures a deep copy. Incremental and
+// Mirror copies were made for syncing master GOPATH backups;
+// since snapshots replaced those, they keep jails in sync
+// (see InitJail), and restoring a snapshot compares files
+// the same way (see sameContents).
 type deepCopyConfig struct {
-	Source        string // source folder
-	Dest          string // destination folder
-	SkipHidden    bool   // skip hidden files (files or folders starting with ".")
-	SkipSymLinks  bool   // skip symbolic links
-	SkipTestFiles bool   // skips *_test.go files and testdata folders - TODO: doesn't generalize well; maybe a SkipFn instead?
-	PreserveOwner bool   // preserve file/folder ownership
+	Source        string     // source folder
+	Dest          string     // destination folder
+	SkipHidden    bool       // skip hidden files (files or folders starting with ".")
+	SkipSymLinks  bool       // skip symbolic links
+	KeepSymLinks  bool       // recreate symbolic links instead of copying what they point to
+	ConfineLinks  bool       // with KeepSymLinks, skip links that point outside of Source; see escapes
+	KeepHardLinks bool       // copy files that are hard links to each other once, and link the copies the same way
+	PreserveOwner bool       // preserve file/folder ownership
+	Owner         int        // uid (and gid) to own copies if not preserving ownership; -1 for no change
+	MaxBytes      int64      // fail instead of writing more than this many bytes of contents (see writesContents); 0 for no limit
+	Method        copyMethod // how file contents are copied
+	Incremental   bool       // skip files whose size, permissions, and modification time match; copies keep that modification time
+	CompareHash   bool       // with Incremental, also compare the contents of files that appear unchanged; see sameContents
+	Mirror        bool       // remove files and folders from Dest that are not copied from Source
+	Workers       int        // how many files to copy at once; 0 or 1 for one at a time
+
+	// Stats, if set, receives the counts of
+	// what the copy did when it succeeds.
+	Stats *copyStats
+
+	// Skip, if set, skips the files and folders
+	// (with all their contents) for which it
+	// returns true.
+	Skip func(path string, info os.FileInfo) bool
+}
+
+// copyMethod is how deepCopy copies the contents of files.
+type copyMethod int
+
+const (
+	copyContents copyMethod = iota // read and write the contents
+	copyHardlink                   // link to the source file (ownership is not changed); see gitMutable
+	copyReflink                    // share the source file's blocks, copy-on-write
+)
+
+// skipTestFiles is a deepCopy skip function which skips
+// what only tests need: testdata folders and _test.go files.
+func skipTestFiles(path string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return info.Name() == "testdata"
+	}
+	return strings.HasSuffix(info.Name(), "_test.go")
+}
+
+// gitMutable returns true if the file at path (relative to
+// the top of a repository) is one that git modifies in place,
+// like the reflog or FETCH_HEAD, rather than by replacing it.
+// Such files must not be shared by hard links. Objects are
+// never modified, and git replaces the other files it writes.
+func gitMutable(path string) bool {
+	path = filepath.ToSlash(strings.TrimPrefix(path, string(filepath.Separator)))
+	return strings.HasPrefix(path, ".git/") && !strings.HasPrefix(path, ".git/objects/")
+}
+
+// writesContents returns true if copying the file at rel
+// (relative to cfg.Source), with info, writes its contents
+// to new blocks, which count against cfg.MaxBytes; hard
+// links and reflinks share the blocks of the source, and
+// recreated symbolic links have no contents.
+func writesContents(cfg deepCopyConfig, rel string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink > 0 && cfg.KeepSymLinks {
+		return false
+	}
+	switch cfg.Method {
+	case copyHardlink:
+		return gitMutable(rel)
+	case copyReflink:
+		return false
+	}
+	return true
 }
 
-// deepCopy makes a deep copy according to cfg, overwriting any existing files.
-// cfg.Source and cfg.Dest are required. File and folder permissions are always
-// preserved. If an error is returned, not all files were copied successfully.
-// This function blocks.
+// deepCopy makes a deep copy according to cfg, overwriting any existing files
+// (unless cfg.Incremental finds them unchanged). cfg.Source and cfg.Dest are
+// required. File and folder permissions are always preserved. Everything is
+// synced to disk once at the end, rather than file by file. If an error is
+// returned, not all files were copied successfully. This function blocks.
 func deepCopy(cfg deepCopyConfig) error {
 	if cfg.Source == "" || cfg.Dest == "" {
 		return fmt.Errorf("no source or no destination; both required")
@@ -181,7 +252,7 @@ func deepCopy(cfg deepCopyConfig) error {
 			}
 			return nil
 		} else {
-			return chown(destPath)
+			return chown(destPath, cfg.Owner)
 		}
 	}
 
@@ -217,12 +288,62 @@ func deepCopy(cfg deepCopyConfig) error {
 		}
 	}
 
-	// now traverse the source directory and copy each file
-	return filepath.Walk(cfg.Source, func(path string, info os.FileInfo, err error) error {
-		// error accessing current file
+	// now traverse the source directory; folders are made
+	// as we go, and files are handed off to the workers
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		mu      sync.Mutex
+		stats   copyStats
+		copyErr error
+		copied  int64
+		kept    = make(map[string]bool)   // relative paths of what is in the copy
+		inodes  = make(map[fileID]string) // with KeepHardLinks, first path of files with more than one link
+		links   []hardLink                // with KeepHardLinks, the other paths, to link once copied
+		files   = make(chan fileToCopy)
+		wg      sync.WaitGroup
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return copyErr
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if failed() != nil {
+					continue // drain
+				}
+				n, err := copyFile(cfg, f.path, f.info, setOwner)
+				mu.Lock()
+				if err != nil && copyErr == nil {
+					copyErr = err
+				}
+				if f.info.Mode()&os.ModeSymlink > 0 && cfg.KeepSymLinks && n >= 0 {
+					stats.Links++
+				} else if n >= 0 {
+					stats.Files++
+					stats.Bytes += n
+				} else {
+					stats.Unchanged++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = filepath.Walk(cfg.Source, func(path string, info os.FileInfo, err error) error {
+		// error accessing current file, or copying a previous one
 		if err != nil {
 			return err
 		}
+		if err := failed(); err != nil {
+			return err
+		}
 
 		// skip files/folders without a name
 		if info.Name() == "" {
@@ -232,9 +353,24 @@ func deepCopy(cfg deepCopyConfig) error {
 			return nil
 		}
 
-		// skip symlinks, if requested
-		if cfg.SkipSymLinks && (info.Mode()&os.ModeSymlink > 0) {
-			return nil
+		// skip symlinks, if requested, and those that
+		// lead out of the tree, if they are kept
+		if info.Mode()&os.ModeSymlink > 0 {
+			if cfg.SkipSymLinks {
+				return nil
+			}
+			if cfg.KeepSymLinks && cfg.ConfineLinks {
+				escape, err := escapes(cfg.Source, path)
+				if err != nil {
+					return err
+				}
+				if escape {
+					mu.Lock()
+					stats.Rejected = append(stats.Rejected, path)
+					mu.Unlock()
+					return nil
+				}
+			}
 		}
 
 		// skip hidden folders, if requested
@@ -245,22 +381,30 @@ func deepCopy(cfg deepCopyConfig) error {
 			return nil
 		}
 
-		// skip testdata folders and _test.go files, if requested
-		if cfg.SkipTestFiles {
-			if info.IsDir() && info.Name() == "testdata" {
+		// skip whatever else is unwanted
+		if cfg.Skip != nil && cfg.Skip(path, info) {
+			if info.IsDir() {
 				return filepath.SkipDir
 			}
-			if !info.IsDir() && strings.HasSuffix(info.Name(), "_test.go") {
-				return nil
-			}
+			return nil
 		}
 
+		rel := strings.TrimPrefix(path, cfg.Source)
+		kept[rel] = true
+
 		// if directory, create destination directory (if not
 		// already created by our pre-walk)
 		if info.IsDir() {
-			subdir := strings.TrimPrefix(path, cfg.Source)
-			destDir := filepath.Join(cfg.Dest, subdir)
-			if _, err := os.Stat(destDir); os.IsNotExist(err) {
+			destDir := filepath.Join(cfg.Dest, rel)
+			destInfo, err := os.Lstat(destDir)
+			if err == nil && !destInfo.IsDir() {
+				// a file where the folder should be
+				if err := os.Remove(destDir); err != nil {
+					return err
+				}
+				err = os.ErrNotExist
+			}
+			if os.IsNotExist(err) {
 				err := os.Mkdir(destDir, info.Mode()&os.ModePerm)
 				if err != nil {
 					return err
@@ -269,52 +413,348 @@ func deepCopy(cfg deepCopyConfig) error {
 			return setOwner(info, destDir)
 		}
 
-		// open source file
-		fsrc, err := os.Open(path)
+		// files that are linked to a file that is
+		// copied already only need to be linked
+		if cfg.KeepHardLinks && info.Mode().IsRegular() {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				id := fileID{uint64(st.Dev), uint64(st.Ino)}
+				if first, ok := inodes[id]; ok {
+					links = append(links, hardLink{rel, first})
+					return nil
+				}
+				inodes[id] = rel
+			}
+		}
+
+		// don't copy more than we're allowed to
+		if writesContents(cfg, rel, info) {
+			copied += info.Size()
+			if cfg.MaxBytes > 0 && copied > cfg.MaxBytes {
+				return fmt.Errorf("copying %s: %v", path, errDiskQuota)
+			}
+		}
+
+		files <- fileToCopy{path, info}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if err == nil {
+		err = copyErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// link the copies of hard links
+	for _, link := range links {
+		n, err := copyHardLink(cfg, link)
 		if err != nil {
 			return err
 		}
+		if n < 0 {
+			stats.Unchanged++
+		} else {
+			stats.Files++
+		}
+	}
 
-		// create destination file
-		destPath := filepath.Join(cfg.Dest, strings.TrimPrefix(path, cfg.Source))
-		fdest, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode()&os.ModePerm)
-		if err != nil {
-			fsrc.Close()
-			if _, err := os.Stat(destPath); err == nil {
-				return fmt.Errorf("opening destination (which already exists): %v", err)
+	// remove what isn't in the source, if requested
+	if cfg.Mirror {
+		err = filepath.Walk(cfg.Dest, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-			return err
+			if kept[strings.TrimPrefix(path, cfg.Dest)] {
+				return nil
+			}
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			stats.Removed++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("removing extraneous files: %v", err)
 		}
+	}
 
-		// set ownership of file
-		err = setOwner(info, destPath)
+	// flush everything to disk at once, which is much
+	// faster than syncing each file as it is written
+	if stats.Files > 0 || stats.Links > 0 || stats.Removed > 0 {
+		err = syncFileSystem(cfg.Dest)
 		if err != nil {
-			return fmt.Errorf("chown destination file: %v", err)
+			return fmt.Errorf("syncing %s: %v", cfg.Dest, err)
 		}
+	}
 
-		// copy the file and ensure it gets flushed to disk
-		if _, err = io.Copy(fdest, fsrc); err != nil {
-			fsrc.Close()
-			fdest.Close()
-			return err
+	if cfg.Stats != nil {
+		*cfg.Stats = stats
+	}
+	return nil
+}
+
+// fileToCopy is a file that deepCopy hands off to its workers.
+type fileToCopy struct {
+	path string
+	info os.FileInfo
+}
+
+// fileID identifies a file (rather than a path to it)
+// by its device and inode numbers.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLink is a file that deepCopy links to the copy of
+// another file, since they are linked in the source; both
+// paths are relative to the source (and destination).
+type hardLink struct {
+	path, target string
+}
+
+// copyHardLink makes the file at link.path in cfg.Dest a hard
+// link to the file at link.target, which must have been copied
+// already, replacing what is there. It returns 0, or -1 if the
+// link was already there (see cfg.Incremental).
+func copyHardLink(cfg deepCopyConfig, link hardLink) (int64, error) {
+	destPath := filepath.Join(cfg.Dest, link.path)
+	targetPath := filepath.Join(cfg.Dest, link.target)
+	if destInfo, err := os.Lstat(destPath); err == nil {
+		if cfg.Incremental {
+			targetInfo, err := os.Lstat(targetPath)
+			if err == nil && os.SameFile(destInfo, targetInfo) {
+				return -1, nil
+			}
 		}
-		if err = fdest.Sync(); err != nil {
-			fsrc.Close()
-			fdest.Close()
-			return err
+		if err := os.RemoveAll(destPath); err != nil {
+			return 0, err
+		}
+	}
+	return 0, os.Link(targetPath, destPath)
+}
+
+// copyFile copies the file at path (with info), which is in cfg.Source, to
+// the same place in cfg.Dest, replacing what is there, and sets
+// its ownership with setOwner. It returns how many bytes it
+// copied, or -1 if the file was unchanged (see cfg.Incremental).
+func copyFile(cfg deepCopyConfig, path string, info os.FileInfo, setOwner func(os.FileInfo, string) error) (int64, error) {
+	rel := strings.TrimPrefix(path, cfg.Source)
+	destPath := filepath.Join(cfg.Dest, rel)
+
+	if info.Mode()&os.ModeSymlink > 0 && cfg.KeepSymLinks {
+		return copyLink(cfg, path, info, destPath)
+	}
+
+	if destInfo, err := os.Lstat(destPath); err == nil {
+		if destInfo.IsDir() || destInfo.Mode()&os.ModeSymlink > 0 {
+			// a folder or link where the file should be (a link
+			// must not be opened, since it leads somewhere else)
+			if err := os.RemoveAll(destPath); err != nil {
+				return 0, err
+			}
+		} else if cfg.Incremental {
+			same, err := sameContents(cfg, path, info, destPath, destInfo)
+			if err != nil {
+				return 0, fmt.Errorf("comparing %s: %v", path, err)
+			}
+			if same {
+				return -1, nil
+			}
 		}
+	}
 
-		// close both files
-		if err = fsrc.Close(); err != nil {
-			fdest.Close()
-			return err
+	// links replace any existing file
+	if cfg.Method == copyHardlink && !gitMutable(rel) {
+		os.Remove(destPath)
+		return info.Size(), os.Link(path, destPath)
+	}
+
+	// open source file
+	fsrc, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fsrc.Close()
+
+	// create destination file
+	fdest, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode()&os.ModePerm)
+	if err != nil {
+		if _, err := os.Stat(destPath); err == nil {
+			return 0, fmt.Errorf("opening destination (which already exists): %v", err)
 		}
-		if err = fdest.Close(); err != nil {
-			return err
+		return 0, err
+	}
+
+	// set ownership and permissions of file (an existing
+	// file keeps its permissions when it is opened)
+	err = setOwner(info, destPath)
+	if err != nil {
+		fdest.Close()
+		return 0, fmt.Errorf("chown destination file: %v", err)
+	}
+	err = fdest.Chmod(info.Mode() & os.ModePerm)
+	if err != nil {
+		fdest.Close()
+		return 0, err
+	}
+
+	// copy the file
+	var n int64
+	if cfg.Method == copyReflink {
+		err = reflink(fdest, fsrc)
+		n = info.Size()
+	} else {
+		n, err = io.Copy(fdest, fsrc)
+	}
+	if err != nil {
+		fdest.Close()
+		return 0, err
+	}
+	if err = fdest.Close(); err != nil {
+		return 0, err
+	}
+
+	// keep the modification time, so the next
+	// incremental copy can tell it is unchanged
+	if cfg.Incremental {
+		err = os.Chtimes(destPath, info.ModTime(), info.ModTime())
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		return nil
-	})
+	return n, nil
+}
+
+// copyLink recreates the symbolic link at path (with info), which
+// is in cfg.Source, at destPath, replacing what is there; it keeps
+// the link's target as it is. It returns 0, or -1 if a link with
+// the same target was already there (see cfg.Incremental).
+func copyLink(cfg deepCopyConfig, path string, info os.FileInfo, destPath string) (int64, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return 0, err
+	}
+	if destInfo, err := os.Lstat(destPath); err == nil {
+		if cfg.Incremental && destInfo.Mode()&os.ModeSymlink > 0 {
+			if destTarget, err := os.Readlink(destPath); err == nil && destTarget == target {
+				return -1, nil
+			}
+		}
+		if err := os.RemoveAll(destPath); err != nil {
+			return 0, err
+		}
+	}
+	err = os.Symlink(target, destPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// links have their own owner, which os.Chown would
+	// not change (it changes what the link points to)
+	uid, gid := cfg.Owner, cfg.Owner
+	if cfg.PreserveOwner {
+		statT := info.Sys().(*syscall.Stat_t)
+		uid, gid = int(statT.Uid), int(statT.Gid)
+	}
+	if uid > -1 {
+		err = os.Lchown(destPath, uid, gid)
+		if err != nil {
+			return 0, fmt.Errorf("chown destination link: %v", err)
+		}
+	}
+	return 0, nil
+}
+
+// escapes returns true if the symbolic link at path, which
+// is in the tree at root, points outside of that tree: if its
+// target is absolute (so a copy of it would still point into
+// the original tree), or if resolving it leads outside of root,
+// either by its path alone or by following other links.
+func escapes(root, path string) (bool, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false, err
+	}
+	if filepath.IsAbs(target) {
+		return true, nil
+	}
+	outside := func(root, path string) bool {
+		rel, err := filepath.Rel(root, path)
+		return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if outside(root, filepath.Join(filepath.Dir(path), target)) {
+		return true, nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, nil // dangling; nothing to escape to
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	return outside(realRoot, resolved), nil
+}
+
+// sameContents returns true if the destination file (at destPath,
+// with destInfo) appears to be the same as the source file (at
+// srcPath, with srcInfo): their sizes, permissions, and modification
+// times match, and if cfg.CompareHash is set, so do their contents.
+func sameContents(cfg deepCopyConfig, srcPath string, srcInfo os.FileInfo, destPath string, destInfo os.FileInfo) (bool, error) {
+	if !destInfo.Mode().IsRegular() ||
+		destInfo.Size() != srcInfo.Size() ||
+		destInfo.Mode().Perm() != srcInfo.Mode().Perm() ||
+		!destInfo.ModTime().Equal(srcInfo.ModTime()) {
+		return false, nil
+	}
+	if !cfg.CompareHash {
+		return true, nil
+	}
+	srcSum, err := fileHash(srcPath)
+	if err != nil {
+		return false, err
+	}
+	destSum, err := fileHash(destPath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcSum, destSum), nil
+}
+
+// fileHash returns the SHA-256 hash of the file at path.
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyStats counts what a deep copy did.
+type copyStats struct {
+	Files     int      // files copied
+	Bytes     int64    // bytes copied
+	Links     int      // symbolic links recreated
+	Unchanged int      // files (and links) skipped because they were unchanged
+	Removed   int      // files and folders removed from the destination
+	Rejected  []string // symbolic links skipped because they point outside of the source
+}
+
+// String summarizes s for logs.
+func (s copyStats) String() string {
+	return fmt.Sprintf("%d files (%d bytes) and %d links copied, %d unchanged, %d removed, %d links rejected",
+		s.Files, s.Bytes, s.Links, s.Unchanged, s.Removed, len(s.Rejected))
 }
 
 // DeployRequest represents a request to test an updated
@@ -327,9 +767,36 @@ type DeployRequest struct {
 	PluginPackage string `json:"plugin_package"`
 	PluginVersion string `json:"plugin_version"`
 
+	// The git clone URL of the plugin, if it is not
+	// fetched from its import path (like a fork).
+	PluginRepo string `json:"plugin_repo,omitempty"`
+
 	// The list of platforms on which the plugin(s) must
 	// build successfully.
 	RequiredPlatforms []Platform `json:"required_platforms"`
+
+	// If true, run the deploy without changing the master
+	// GOPATH, to see whether it would succeed and which
+	// dependencies it would update.
+	DryRun bool `json:"dry_run"`
+}
+
+// RestoreSnapshotRequest is a request to restore
+// the master GOPATH to a snapshot.
+type RestoreSnapshotRequest struct {
+	ID string `json:"id"`
+}
+
+// PruneRequest is a request to prune the master GOPATH.
+type PruneRequest struct {
+	// The import (package) paths of the plugins that are
+	// currently registered; they and their dependencies
+	// are kept.
+	Plugins []string `json:"plugins"`
+
+	// How long to keep repositories that were used by a
+	// build after it was last used, like "168h" (the default).
+	KeepUsedWithin string `json:"keep_used_within"`
 }
 
 // BuildRequest is a request for a build of Caddy.
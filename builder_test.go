@@ -0,0 +1,108 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{filepath.Join(root, "a", "b"), filepath.Join(dir, "outside")} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		link   string // relative to root
+		target string
+		expect bool
+	}{
+		{link: "a/sibling", target: "b", expect: false},
+		{link: "a/b/up", target: "../../file", expect: false},
+		{link: "a/dangling", target: "missing", expect: false},
+		{link: "a/absolute", target: filepath.Join(root, "file"), expect: true},
+		{link: "a/out", target: "../../outside", expect: true},
+		{link: "a/dotdot", target: "../..", expect: true},
+		{link: "toroot", target: ".", expect: false},
+
+		// each link stays inside, but together they escape
+		{link: "a/b/hop", target: "../../escape", expect: false},
+		{link: "escape", target: "../outside", expect: true},
+		{link: "a/viahop", target: "b/hop", expect: true},
+	} {
+		path := filepath.Join(root, filepath.FromSlash(test.link))
+		err := os.Symlink(test.target, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := escapes(root, path)
+		if err != nil {
+			t.Errorf("Test %d (%s -> %s): Expected no error, got: %v", i, test.link, test.target, err)
+			continue
+		}
+		if actual != test.expect {
+			t.Errorf("Test %d (%s -> %s): Expected %v, got %v", i, test.link, test.target, test.expect, actual)
+		}
+	}
+
+	if _, err := escapes(root, filepath.Join(root, "file")); err == nil {
+		t.Error("Expected an error for a file that is not a link, got none")
+	}
+}
+
+func TestWritesContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, link := filepath.Join(dir, "file"), filepath.Join(dir, "link")
+	err = ioutil.WriteFile(file, []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Lstat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkInfo, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		cfg    deepCopyConfig
+		rel    string
+		info   os.FileInfo
+		expect bool
+	}{
+		{cfg: deepCopyConfig{Method: copyContents}, rel: "/file", info: fileInfo, expect: true},
+		{cfg: deepCopyConfig{Method: copyHardlink}, rel: "/file", info: fileInfo, expect: false},
+		{cfg: deepCopyConfig{Method: copyHardlink}, rel: "/.git/objects/ab/cdef", info: fileInfo, expect: false},
+		{cfg: deepCopyConfig{Method: copyHardlink}, rel: "/.git/FETCH_HEAD", info: fileInfo, expect: true},
+		{cfg: deepCopyConfig{Method: copyReflink}, rel: "/file", info: fileInfo, expect: false},
+		{cfg: deepCopyConfig{Method: copyContents, KeepSymLinks: true}, rel: "/link", info: linkInfo, expect: false},
+		{cfg: deepCopyConfig{Method: copyContents}, rel: "/link", info: linkInfo, expect: true},
+	} {
+		if actual := writesContents(test.cfg, test.rel, test.info); actual != test.expect {
+			t.Errorf("Test %d (%s): Expected %v, got %v", i, test.rel, test.expect, actual)
+		}
+	}
+}
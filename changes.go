@@ -0,0 +1,96 @@
+package buildworker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// repoCommits returns the commit that each repository
+// in the master GOPATH has checked out, by its path
+// relative to the src folder.
+func (be BuildEnv) repoCommits() (map[string]string, error) {
+	be.tmpGopath = "" // only the master GOPATH is involved
+
+	rlock(be.masterGopath)
+	defer runlock(be.masterGopath)
+
+	repos, err := be.masterRepos()
+	if err != nil {
+		return nil, err
+	}
+	commits := make(map[string]string)
+	for repo := range repos {
+		commit, err := be.gitOutput(be.Path(repo), "rev-parse", "HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", repo, err)
+		}
+		commits[repo] = commit
+	}
+	return commits, nil
+}
+
+// diffCommits returns the repositories whose commits
+// differ between before and after, sorted by path.
+func diffCommits(before, after map[string]string) []RepoChange {
+	var changes []RepoChange
+	for repo, old := range before {
+		if after[repo] != old {
+			changes = append(changes, RepoChange{Repo: repo, Old: old, New: after[repo]})
+		}
+	}
+	for repo, commit := range after {
+		if _, ok := before[repo]; !ok {
+			changes = append(changes, RepoChange{Repo: repo, New: commit})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Repo < changes[j].Repo
+	})
+	return changes
+}
+
+// describeChanges fills in the log of each change to a
+// repository in the master GOPATH: the summaries of the
+// commits that were added between the old and the new
+// commit. The changes are also written to the log of the
+// build environment. Changes are returned for convenience.
+func (be BuildEnv) describeChanges(changes []RepoChange) []RepoChange {
+	be.tmpGopath = "" // only the master GOPATH is involved
+	for i, change := range changes {
+		be.log.Printf("%s changed: %s -> %s", change.Repo, orNone(change.Old), orNone(change.New))
+		if change.Old == "" || change.New == "" {
+			continue
+		}
+		out, err := be.gitOutput(be.Path(change.Repo), "log", "--oneline", "--no-decorate",
+			"-n", strconv.Itoa(maxChangeLog+1), change.Old+".."+change.New)
+		if err != nil {
+			be.log.Printf("summarizing changes to %s: %v", change.Repo, err)
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if line == "" {
+				continue
+			}
+			if len(changes[i].Log) == maxChangeLog {
+				changes[i].Log = append(changes[i].Log, "...")
+				break
+			}
+			changes[i].Log = append(changes[i].Log, line)
+		}
+	}
+	return changes
+}
+
+// orNone returns commit, or "(none)" if it is empty.
+func orNone(commit string) string {
+	if commit == "" {
+		return "(none)"
+	}
+	return commit
+}
+
+// maxChangeLog is how many commits are listed in the
+// log of a change to a repository, at most.
+const maxChangeLog = 50
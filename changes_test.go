@@ -0,0 +1,46 @@
+package buildworker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffCommits(t *testing.T) {
+	for i, test := range []struct {
+		before, after map[string]string
+		expect        []RepoChange
+	}{
+		{
+			before: nil,
+			after:  nil,
+			expect: nil,
+		},
+		{
+			before: map[string]string{"a": "1", "b": "2"},
+			after:  map[string]string{"a": "1", "b": "2"},
+			expect: nil,
+		},
+		{
+			before: map[string]string{"c": "1", "a": "2", "gone": "3"},
+			after:  map[string]string{"c": "4", "a": "2", "new": "5"},
+			expect: []RepoChange{
+				{Repo: "c", Old: "1", New: "4"},
+				{Repo: "gone", Old: "3"},
+				{Repo: "new", New: "5"},
+			},
+		},
+		{
+			before: nil,
+			after:  map[string]string{"b": "1", "a": "2"},
+			expect: []RepoChange{
+				{Repo: "a", New: "2"},
+				{Repo: "b", New: "1"},
+			},
+		},
+	} {
+		actual := diffCommits(test.before, test.after)
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expect, actual)
+		}
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
@@ -26,7 +28,26 @@ func init() {
 	flag.StringVar(&addr, "addr", addr, "The address (host:port) to listen on")
 	flag.StringVar(&logfile, "log", logfile, "Log file (or stdout/stderr; empty for none)")
 	flag.IntVar(&buildworker.UidGid, "uid", buildworker.UidGid, "The uid and gid to run commands as (-1 for no change) (use with -chroot)")
+	flag.StringVar(&buildworker.UidRange, "uid-range", buildworker.UidRange, "Range of uids (like 100000-100999) from which each build leases its own uid")
 	flag.StringVar(&buildworker.Chroot, "chroot", buildworker.Chroot, "The directory to chroot commands in (use with -uid)")
+	flag.StringVar(&buildworker.Sandbox, "sandbox", buildworker.Sandbox, "Sandbox backend to run commands in (empty or \"namespaces\")")
+	flag.StringVar(&buildworker.Hardening, "harden", buildworker.Hardening, "Harden commands with no_new_privs, no capabilities, and seccomp (empty, \"on\", or \"strict\")")
+	flag.StringVar(&buildworker.SeccompProfile, "seccomp-profile", buildworker.SeccompProfile, "JSON file listing the system calls commands may use (use with -harden)")
+	flag.BoolVar(&buildworker.SmokeTest, "smoke-test", buildworker.SmokeTest, "Run builds for this platform with -version and -plugins before returning them")
+	flag.BoolVar(&buildworker.VerifyRestore, "verify-restore", buildworker.VerifyRestore, "Compare file contents when checking whether restoring a snapshot can leave a repository as it is")
+	flag.BoolVar(&buildworker.MeasureCoverage, "coverage", buildworker.MeasureCoverage, "Measure test coverage of plugins being deployed")
+	flag.Float64Var(&buildworker.MinCoverage, "min-coverage", buildworker.MinCoverage, "Minimum test coverage (percent) of plugins being deployed (use with -coverage)")
+	flag.IntVar(&buildworker.TestRetries, "test-retries", buildworker.TestRetries, "How many times to retry failing tests (0 to disable)")
+	flag.BoolVar(&buildworker.FailOnFlakyTests, "fail-flaky", buildworker.FailOnFlakyTests, "Fail checks if tests fail and then pass when retried")
+	flag.StringVar(&buildworker.ProvisionStrategy, "provision", buildworker.ProvisionStrategy, "How to copy repositories into temporary GOPATHs: copy, clone, hardlink, reflink, or overlay")
+	flag.Int64Var(&diskQuotaMiB, "disk-quota", diskQuotaMiB, "Disk space (MiB) each build may use for its temporary GOPATH and outputs (0 for no limit)")
+	flag.Int64Var(&minFreeSpaceMiB, "min-free-space", minFreeSpaceMiB, "Free disk space (MiB) needed to start a build (0 to not check)")
+	flag.StringVar(&buildworker.CredentialsFile, "credentials", buildworker.CredentialsFile, "JSON file with the SSH keys and HTTPS tokens for private repositories, by host")
+	flag.IntVar(&buildworker.SnapshotRetention, "snapshots", buildworker.SnapshotRetention, "How many snapshots of the master GOPATH to keep (0 for all)")
+	flag.IntVar(&buildworker.LockFileRetention, "lock-files", buildworker.LockFileRetention, "How many lock files of the master GOPATH to keep (0 for all)")
+	flag.DurationVar(&gcInterval, "gc-interval", gcInterval, "How often to remove stale temporary directories (0 to only do it at startup)")
+	flag.DurationVar(&gcMaxAge, "gc-age", gcMaxAge, "How old a temporary directory must be to be considered stale")
+	flag.StringVar(&forbiddenImports, "forbidden-imports", forbiddenImports, "Comma-separated list of packages plugins may not import")
 	setAPICredentials()
 	setSigningKey()
 }
@@ -37,12 +58,60 @@ func main() {
 	if buildworker.UidGid < -1 || buildworker.UidGid > 0xFFFFFFFF {
 		log.Fatal("bad uid/gid (must be uint32 or -1 to disable)")
 	}
-	if buildworker.UidGid == -1 && buildworker.Chroot == "" {
-		fmt.Println("WARNING: Running as same user and without jail!")
+	if err := buildworker.LoadCredentials(); err != nil {
+		log.Fatal(err)
 	}
-	if (buildworker.UidGid == -1 && buildworker.Chroot != "") ||
-		(buildworker.UidGid != -1 && buildworker.Chroot == "") {
-		fmt.Println("WARNING: Either -uid or -chroot is set, but not both; inconsistent use!")
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "jail":
+			jailCommand(flag.Args()[1:])
+		case "snapshot":
+			snapshotCommand(flag.Args()[1:])
+		default:
+			log.Fatalf("unknown command: %s", flag.Arg(0))
+		}
+		return
+	}
+	if buildworker.Sandbox == "" {
+		if buildworker.UidGid == -1 && buildworker.Chroot == "" {
+			fmt.Println("WARNING: Running as same user and without jail!")
+		}
+		if (buildworker.UidGid == -1 && buildworker.Chroot != "") ||
+			(buildworker.UidGid != -1 && buildworker.Chroot == "") {
+			fmt.Println("WARNING: Either -uid or -chroot is set, but not both; inconsistent use!")
+		}
+	} else if buildworker.Chroot != "" {
+		fmt.Println("WARNING: -chroot is ignored when -sandbox is set")
+	}
+	if err := buildworker.CheckProvisionStrategy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := buildworker.CheckUidRange(); err != nil {
+		log.Fatal(err)
+	}
+	if buildworker.Sandbox == "" && buildworker.Chroot != "" {
+		if err := buildworker.CheckJail(buildworker.Chroot, buildworker.UidGid); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := buildworker.CheckSandbox(); err != nil {
+		log.Fatal(err)
+	}
+	if err := buildworker.CheckHardening(); err != nil {
+		if buildworker.Hardening == buildworker.HardeningStrict {
+			log.Fatal(err)
+		}
+		fmt.Println("WARNING: Hardening:", err)
+	}
+
+	buildworker.DiskQuota = diskQuotaMiB << 20
+	buildworker.MinFreeSpace = minFreeSpaceMiB << 20
+
+	buildworker.ForbiddenImports = nil
+	for _, pkg := range strings.Split(forbiddenImports, ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" {
+			buildworker.ForbiddenImports = append(buildworker.ForbiddenImports, pkg)
+		}
 	}
 
 	// set up log before anything bad happens
@@ -62,6 +131,26 @@ func main() {
 		})
 	}
 
+	// finish restoring the master GOPATH if the build
+	// worker died while doing it; until then, it refuses
+	// builds and deploys
+	snapID, logStr, err := buildworker.ResumeRestore()
+	if err != nil {
+		log.Printf("resuming restore of master GOPATH to snapshot %s: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", snapID, err, logStr)
+		fmt.Println("WARNING: Master GOPATH is inconsistent; builds are refused until it is restored:", err)
+	} else if snapID != "" {
+		log.Printf("finished restoring master GOPATH to snapshot %s", snapID)
+	}
+
+	collectGarbage()
+	if gcInterval > 0 {
+		go func() {
+			for range time.Tick(gcInterval) {
+				collectGarbage()
+			}
+		}()
+	}
+
 	addRoute := func(method, path string, h http.HandlerFunc) {
 		http.HandleFunc(path, methodHandler(method, maxSizeHandler(authHandler(h))))
 	}
@@ -86,20 +175,28 @@ func main() {
 			log.Printf("setting up build env to deploy Caddy: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", err, logStr)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr})
+			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr, Report: be.Report})
 			return
 		}
 		defer be.Close()
+		defer logUsage("deploying Caddy "+info.CaddyVersion, be.Report)
 
-		err = be.Deploy(nil) // no required platforms since checks should have already been performed
+		if info.DryRun {
+			err = be.DeployDryRun(nil)
+		} else {
+			err = be.Deploy(nil) // no required platforms since checks should have already been performed
+		}
 		if err != nil {
 			logStr := be.Log.String()
 			log.Printf("deploying Caddy: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", err, logStr)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr})
+			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr, Report: be.Report})
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(be.Report)
 	})
 
 	addRoute("POST", "/deploy-plugin", func(w http.ResponseWriter, r *http.Request) {
@@ -117,26 +214,34 @@ func main() {
 		}
 
 		be, err := buildworker.Open(info.CaddyVersion, []buildworker.CaddyPlugin{
-			{Package: info.PluginPackage, Version: info.PluginVersion},
+			{Package: info.PluginPackage, Version: info.PluginVersion, Repo: info.PluginRepo},
 		})
 		if err != nil {
 			log.Printf("setting up deploy environment: %v", err)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String(), Report: be.Report})
 			return
 		}
 		defer be.Close()
+		defer logUsage("deploying plugin "+info.PluginPackage+" "+info.PluginVersion, be.Report)
 
-		err = be.Deploy(info.RequiredPlatforms)
+		if info.DryRun {
+			err = be.DeployDryRun(info.RequiredPlatforms)
+		} else {
+			err = be.Deploy(info.RequiredPlatforms)
+		}
 		if err != nil {
 			logStr := be.Log.String()
 			log.Printf("deploying plugin: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", err, logStr)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr})
+			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr, Report: be.Report})
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(be.Report)
 	})
 
 	addRoute("POST", "/build", func(w http.ResponseWriter, r *http.Request) {
@@ -153,7 +258,94 @@ func main() {
 			return
 		}
 
-		httpBuild(w, info.BuildConfig.CaddyVersion, info.BuildConfig.Plugins, info.Platform)
+		httpBuild(w, info.BuildConfig, info.Platform)
+	})
+
+	addRoute("POST", "/prune-master-gopath", func(w http.ResponseWriter, r *http.Request) {
+		var info buildworker.PruneRequest
+		err := json.NewDecoder(r.Body).Decode(&info)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keepUsedWithin := 7 * 24 * time.Hour
+		if info.KeepUsedWithin != "" {
+			keepUsedWithin, err = time.ParseDuration(info.KeepUsedWithin)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		removed, reclaimed, err := buildworker.PruneMasterGopath(info.Plugins, keepUsedWithin)
+		log.Printf("pruned %d repositories from master GOPATH, reclaiming %d KiB: %s",
+			len(removed), reclaimed/1024, strings.Join(removed, ", "))
+		if err != nil {
+			log.Printf("pruning master GOPATH: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Error{Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Removed        []string `json:"removed"`
+			ReclaimedBytes int64    `json:"reclaimed_bytes"`
+		}{removed, reclaimed})
+	})
+
+	addRoute("GET", "/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		snaps, err := buildworker.Snapshots()
+		if err != nil {
+			log.Printf("listing snapshots: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Error{Message: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snaps)
+	})
+
+	addRoute("POST", "/restore-snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var info buildworker.RestoreSnapshotRequest
+		err := json.NewDecoder(r.Body).Decode(&info)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if info.ID == "" {
+			http.Error(w, "missing required field", http.StatusBadRequest)
+			return
+		}
+
+		logStr, err := buildworker.RestoreSnapshot(info.ID)
+		if err != nil {
+			log.Printf("restoring snapshot %s: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", info.ID, err, logStr)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr})
+			return
+		}
+		log.Printf("restored master GOPATH to snapshot %s", info.ID)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	addRoute("GET", "/health", func(w http.ResponseWriter, r *http.Request) {
+		err := buildworker.CheckMasterGopath()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Error{Message: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 
 	addRoute("GET", "/supported-platforms", func(w http.ResponseWriter, r *http.Request) {
@@ -168,10 +360,84 @@ func main() {
 	http.ListenAndServe(addr, nil)
 }
 
+// jailCommand runs the jail subcommand with args:
+// "init <dir>" assembles a jail for -chroot at dir, and
+// "check [<dir>]" checks that the jail at dir (or the
+// -chroot directory) works. Both use the -uid flag.
+func jailCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: buildworker [flags] jail init <dir> | jail check [<dir>]")
+	}
+	dir := buildworker.Chroot
+	if len(args) > 1 {
+		dir = args[1]
+	}
+	if dir == "" {
+		log.Fatal("no jail directory given")
+	}
+	switch args[0] {
+	case "init":
+		if len(args) < 2 {
+			log.Fatal("usage: buildworker [flags] jail init <dir>")
+		}
+		err := buildworker.InitJail(dir, buildworker.UidGid)
+		if err != nil {
+			log.Fatalf("initializing jail: %v", err)
+		}
+		fmt.Println("Jail initialized at", dir)
+		fmt.Println("Bind-mount the master GOPATH and the temporary directory into it, then run: buildworker jail check", dir)
+	case "check":
+		err := buildworker.CheckJail(dir, buildworker.UidGid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Jail at", dir, "works")
+	default:
+		log.Fatalf("unknown jail command: %s", args[0])
+	}
+}
+
+// snapshotCommand runs the snapshot subcommand with args:
+// "list" lists the snapshots of the master GOPATH, "take"
+// takes a new one, and "restore <id>" restores one.
+func snapshotCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: buildworker [flags] snapshot list | snapshot take | snapshot restore <id>")
+	}
+	switch args[0] {
+	case "list":
+		snaps, err := buildworker.Snapshots()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, snap := range snaps {
+			fmt.Printf("%s\t%s\t%d repositories\t%s\n", snap.ID,
+				snap.Created.Local().Format(time.RFC3339), len(snap.Repos), snap.Deploy)
+		}
+	case "take":
+		snap, err := buildworker.TakeSnapshot("")
+		if err != nil {
+			log.Fatalf("taking snapshot: %v", err)
+		}
+		fmt.Println("Took snapshot", snap.ID)
+	case "restore":
+		if len(args) < 2 {
+			log.Fatal("usage: buildworker [flags] snapshot restore <id>")
+		}
+		logStr, err := buildworker.RestoreSnapshot(args[1])
+		if err != nil {
+			log.Fatalf("restoring snapshot: %v\n%s", err, logStr)
+		}
+		fmt.Println("Restored snapshot", args[1])
+	default:
+		log.Fatalf("unknown snapshot command: %s", args[0])
+	}
+}
+
 // httpBuild builds Caddy according to the configuration in cfg
 // and plat, and immediately streams the binary into the response
 // body of w.
-func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker.CaddyPlugin, plat buildworker.Platform) {
+func httpBuild(w http.ResponseWriter, cfg buildworker.BuildConfig, plat buildworker.Platform) {
 	internalErr := func(intro string, err error) {
 		log.Printf("%s: %v", intro, err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
@@ -184,28 +450,19 @@ func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker
 		return
 	}
 	defer os.RemoveAll(tmpdir)
-	if buildworker.UidGid > -1 {
-		err = os.Chown(tmpdir, buildworker.UidGid, buildworker.UidGid)
-		if err != nil {
-			internalErr("error making temporary directory", err)
-			return
-		}
-	}
+	defer buildworker.UseDir(tmpdir)()
 
-	// TODO: This does a deep copy of all plugins including their
-	// testdata folders and test files. We might be able to
-	// add parameters to an alternate Open function so that it can be configured
-	// to only copy certain things if we want it to...
-	be, err := buildworker.Open(caddyVersion, plugins)
+	be, err := buildworker.Open(cfg.CaddyVersion, cfg.Plugins, buildworker.ForBuild(), buildworker.WithLock(cfg.LockFile))
 	if err != nil {
 		logStr := be.Log.String()
 		log.Printf("creating build env: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", err, logStr)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String(), Report: be.Report})
 		return
 	}
 	defer be.Close()
+	defer logUsage("building for "+plat.String(), be.Report)
 
 	outputFile, err := be.Build(plat, tmpdir)
 	if err != nil {
@@ -213,7 +470,7 @@ func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker
 		log.Printf("build: %v >>>>>>>>>>>\n%s\n<<<<<<<<<<<\n", err, logStr)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr})
+		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: logStr, Report: be.Report})
 		return
 	}
 	defer outputFile.Close()
@@ -236,8 +493,19 @@ func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker
 		return
 	}
 
+	report, err := json.Marshal(be.Report)
+	if err != nil {
+		internalErr("encoding report", err)
+		return
+	}
+
 	writer := multipart.NewWriter(w)
 	w.Header().Set("Content-Type", writer.FormDataContentType())
+	err = writer.WriteField("report", string(report))
+	if err != nil {
+		internalErr("writing report into form", err)
+		return
+	}
 	if buildworker.Signer != nil {
 		part, err := writer.CreateFormFile("signature", signatureName)
 		if err != nil {
@@ -269,6 +537,26 @@ func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker
 	return
 }
 
+// collectGarbage removes stale temporary directories
+// and logs what was removed.
+func collectGarbage() {
+	removed, reclaimed, err := buildworker.CollectGarbage(gcMaxAge)
+	if err != nil {
+		log.Printf("collecting garbage: %v", err)
+	}
+	if len(removed) > 0 {
+		log.Printf("removed %d stale temporary directories, reclaiming %d KiB: %s",
+			len(removed), reclaimed/1024, strings.Join(removed, ", "))
+	}
+}
+
+// logUsage writes the resources used by the commands
+// in a build environment, as recorded in report, to
+// the log; what describes the use of the environment.
+func logUsage(what string, report *buildworker.Report) {
+	log.Printf("resource usage of %s: %s", what, report.UsageSummary())
+}
+
 func methodHandler(method string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != method {
@@ -373,10 +661,12 @@ func setSigningKey() {
 }
 
 // Error is a structured way to return an error
-// message along with a detailed log.
+// message along with a detailed log and the
+// structured results of any checks that ran.
 type Error struct {
 	Message string
 	Log     string
+	Report  *buildworker.Report
 }
 
 const (
@@ -404,3 +694,17 @@ const (
 var addr = "127.0.0.1:2017"
 
 var logfile = "buildworker.log"
+
+var forbiddenImports = strings.Join(buildworker.ForbiddenImports, ",")
+
+// Disk space limits, in MiB
+var (
+	diskQuotaMiB    int64
+	minFreeSpaceMiB int64
+)
+
+// Removal of stale temporary directories
+var (
+	gcInterval = 1 * time.Hour
+	gcMaxAge   = 24 * time.Hour
+)
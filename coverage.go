@@ -0,0 +1,111 @@
+package buildworker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Coverage is the test coverage of a plugin.
+type Coverage struct {
+	// Percentage of statements covered across
+	// all of the plugin's packages.
+	Total float64 `json:"total"`
+
+	// Percentage of statements covered, by package.
+	Packages map[string]float64 `json:"packages"`
+}
+
+// parseCoverProfile reads the coverage profile at file (as
+// written by `go test -coverprofile`) and aggregates it.
+func parseCoverProfile(file string) (Coverage, error) {
+	cov := Coverage{Packages: make(map[string]float64)}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return cov, err
+	}
+	defer f.Close()
+
+	// a block may be listed more than once if it was
+	// covered by more than one test binary; it is
+	// covered if any of them covered it
+	type block struct {
+		stmts   int
+		covered bool
+	}
+	blocks := make(map[string]block)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// format is "file.go:line.col,line.col numStmts count"
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return cov, fmt.Errorf("malformed coverage line: %s", line)
+		}
+		stmts, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return cov, fmt.Errorf("malformed statement count: %s", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return cov, fmt.Errorf("malformed coverage count: %s", line)
+		}
+		b := blocks[fields[0]]
+		b.stmts = stmts
+		b.covered = b.covered || count > 0
+		blocks[fields[0]] = b
+	}
+	if err := scanner.Err(); err != nil {
+		return cov, err
+	}
+
+	var total, covered int
+	pkgTotal := make(map[string]int)
+	pkgCovered := make(map[string]int)
+	for pos, b := range blocks {
+		pkg := path.Dir(pos[:strings.LastIndex(pos, ":")])
+		total += b.stmts
+		pkgTotal[pkg] += b.stmts
+		if b.covered {
+			covered += b.stmts
+			pkgCovered[pkg] += b.stmts
+		}
+	}
+	cov.Total = percent(covered, total)
+	for pkg, n := range pkgTotal {
+		cov.Packages[pkg] = percent(pkgCovered[pkg], n)
+	}
+
+	return cov, nil
+}
+
+// percent returns n as a percentage of total.
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// These variables control coverage reporting for plugin
+// deploys. Coverage is only measured for the plugin's
+// own tests, not for Caddy's tests.
+var (
+	// MeasureCoverage enables measuring test coverage
+	// of plugins during the plugin checks.
+	MeasureCoverage bool
+
+	// MinCoverage is the minimum percentage of
+	// statements that a plugin's tests must cover
+	// for the plugin checks to pass. It only has
+	// an effect if MeasureCoverage is enabled.
+	MinCoverage float64
+)
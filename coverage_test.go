@@ -0,0 +1,89 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCoverProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		profile     string
+		expectTotal float64
+		expectPkgs  map[string]float64
+		shouldErr   bool
+	}{
+		{
+			profile:     "mode: set\n",
+			expectTotal: 0,
+			expectPkgs:  map[string]float64{},
+		},
+		{
+			profile: "mode: set\n" +
+				"example.com/p/a.go:1.1,3.2 3 1\n" +
+				"example.com/p/a.go:4.1,6.2 1 0\n",
+			expectTotal: 75,
+			expectPkgs:  map[string]float64{"example.com/p": 75},
+		},
+		{
+			// a block covered by any test binary is covered
+			profile: "mode: count\n" +
+				"example.com/p/a.go:1.1,3.2 2 0\n" +
+				"example.com/p/a.go:1.1,3.2 2 5\n" +
+				"example.com/p/sub/b.go:1.1,3.2 2 0\n",
+			expectTotal: 50,
+			expectPkgs:  map[string]float64{"example.com/p": 100, "example.com/p/sub": 0},
+		},
+		{
+			profile:   "mode: set\nexample.com/p/a.go:1.1,3.2 3\n",
+			shouldErr: true,
+		},
+		{
+			profile:   "mode: set\nexample.com/p/a.go:1.1,3.2 x 1\n",
+			shouldErr: true,
+		},
+		{
+			profile:   "mode: set\nexample.com/p/a.go:1.1,3.2 3 y\n",
+			shouldErr: true,
+		},
+	} {
+		file := filepath.Join(dir, "coverage.out")
+		err := ioutil.WriteFile(file, []byte(test.profile), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cov, err := parseCoverProfile(file)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cov.Total != test.expectTotal {
+			t.Errorf("Test %d: Expected total %v, got %v", i, test.expectTotal, cov.Total)
+		}
+		if len(cov.Packages) != len(test.expectPkgs) {
+			t.Errorf("Test %d: Expected %d packages, got %v", i, len(test.expectPkgs), cov.Packages)
+		}
+		for pkg, expect := range test.expectPkgs {
+			if actual, ok := cov.Packages[pkg]; !ok || actual != expect {
+				t.Errorf("Test %d: Expected %v for %s, got %v (present: %v)", i, expect, pkg, actual, ok)
+			}
+		}
+	}
+
+	if _, err := parseCoverProfile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing file, got none")
+	}
+}
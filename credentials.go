@@ -0,0 +1,205 @@
+package buildworker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CredentialsFile is the path to a JSON file with the
+// credentials needed to fetch private repositories, by
+// host; see HostCredentials. It must not be readable by
+// anyone but its owner. It is loaded by LoadCredentials.
+var CredentialsFile string
+
+// HostCredentials are the credentials for fetching
+// repositories from one host over SSH, HTTPS, or both.
+type HostCredentials struct {
+	// Path to the private SSH key (like a deploy key) to
+	// use for the host, and to the known_hosts file with
+	// its host key, which is required with SSHKey.
+	SSHKey     string `json:"ssh_key,omitempty"`
+	KnownHosts string `json:"known_hosts,omitempty"`
+
+	// Username and token (or password) for HTTPS; the
+	// username defaults to "git", which most servers
+	// accept along with an access token.
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// LoadCredentials loads the credentials in CredentialsFile
+// (if set), replacing any that were loaded before. Commands
+// that download code (and only those) use them for the hosts
+// they are configured for: HTTPS tokens are passed to git as
+// an Authorization header for URLs on the host (rather than
+// by a credential helper, which would need a shell in jails),
+// and SSH keys through an ssh_config file that GIT_SSH_COMMAND
+// points to. Both are given to git in its environment, so the
+// credentials are never written to repositories' configuration
+// or to the log. Keys and known_hosts files must be readable by
+// the users that commands run as. Since those users also run
+// untrusted tests, credentials need the namespaces Sandbox,
+// which hides them (and the processes that have them in their
+// environment) from all other commands; for the same reason,
+// they must not be in a system folder that all commands see.
+func LoadCredentials() error {
+	if loadedCredentials.release != nil {
+		loadedCredentials.release()
+	}
+	loadedCredentials = credentialConfig{}
+	if CredentialsFile == "" {
+		return nil
+	}
+	if Sandbox != SandboxNamespaces {
+		return fmt.Errorf("credentials can only be used with the %s sandbox, which hides them from untrusted commands",
+			SandboxNamespaces)
+	}
+
+	info, err := os.Stat(CredentialsFile)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("credentials file %s must not be accessible by group or others (mode is %s)",
+			CredentialsFile, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(CredentialsFile)
+	if err != nil {
+		return err
+	}
+	var hostCreds map[string]HostCredentials
+	err = json.Unmarshal(data, &hostCreds)
+	if err != nil {
+		return fmt.Errorf("parsing credentials file: %v", err)
+	}
+
+	hosts := make([]string, 0, len(hostCreds))
+	for host := range hostCreds {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var cfg credentialConfig
+	var headers, sshConfig []string
+	for _, host := range hosts {
+		creds := hostCreds[host]
+		if host == "" || strings.ContainsAny(host, "/ \t\n") {
+			return fmt.Errorf("invalid host in credentials file: %q", host)
+		}
+		if creds.Token != "" {
+			username := creds.Username
+			if username == "" {
+				username = "git"
+			}
+			auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + creds.Token))
+			headers = append(headers,
+				"http.https://"+host+"/.extraHeader",
+				"Authorization: Basic "+auth)
+		}
+		if creds.SSHKey != "" {
+			if creds.KnownHosts == "" {
+				return fmt.Errorf("SSH key for %s needs a known_hosts file", host)
+			}
+			for _, file := range []string{creds.SSHKey, creds.KnownHosts} {
+				if !filepath.IsAbs(file) {
+					return fmt.Errorf("path for %s must be absolute: %s", host, file)
+				}
+				if _, err := os.Stat(file); err != nil {
+					return fmt.Errorf("credentials for %s: %v", host, err)
+				}
+				if sandboxExposes(file) {
+					return fmt.Errorf("credentials for %s: %s is in a folder that all commands can read", host, file)
+				}
+				cfg.paths = append(cfg.paths, file)
+			}
+			hostname := host
+			if i := strings.LastIndex(host, ":"); i > -1 {
+				hostname = host[:i] // ssh_config matches host names only
+			}
+			sshConfig = append(sshConfig,
+				"Host "+hostname,
+				"\tIdentityFile "+strconv.Quote(creds.SSHKey),
+				"\tIdentitiesOnly yes",
+				"\tUserKnownHostsFile "+strconv.Quote(creds.KnownHosts),
+				"\tStrictHostKeyChecking yes",
+				"")
+		}
+		if creds.Token == "" && creds.SSHKey == "" {
+			return fmt.Errorf("no token or SSH key for %s", host)
+		}
+	}
+
+	cfg.env = []string{"GIT_TERMINAL_PROMPT=0"}
+	if len(headers) > 0 {
+		cfg.env = append(cfg.env, "GIT_CONFIG_COUNT="+strconv.Itoa(len(headers)/2))
+		for i := 0; i < len(headers); i += 2 {
+			cfg.env = append(cfg.env,
+				fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i/2, headers[i]),
+				fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i/2, headers[i+1]))
+		}
+	}
+	if len(sshConfig) > 0 {
+		// the ssh_config holds only paths, not secrets, but it
+		// must not be replaced by anyone else, so it goes into
+		// a new folder (which the sandbox shows only to the
+		// commands that get the credentials)
+		dir, err := ioutil.TempDir("", "buildworker_credentials_")
+		if err != nil {
+			return err
+		}
+		err = writeSSHConfig(dir, strings.Join(sshConfig, "\n"))
+		if err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("writing ssh_config: %v", err)
+		}
+		releaseDir := UseDir(dir)
+		cfg.release = func() {
+			os.RemoveAll(dir)
+			releaseDir()
+		}
+		file := filepath.Join(dir, "ssh_config")
+		cfg.env = append(cfg.env, "GIT_SSH_COMMAND=ssh -F "+strconv.Quote(file)+" -o BatchMode=yes")
+		cfg.paths = append(cfg.paths, dir)
+	}
+
+	loadedCredentials = cfg
+	return nil
+}
+
+// writeSSHConfig writes config to a new ssh_config file in
+// dir, which must have just been made by this process, and
+// lets the users that commands run as read both.
+func writeSSHConfig(dir, config string) error {
+	err := os.Chmod(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "ssh_config"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(config)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// credentialConfig is how the loaded credentials
+// are given to commands that download code.
+type credentialConfig struct {
+	env     []string // environment variables for git
+	paths   []string // files the commands need to read
+	release func()   // removes the files made for the commands, if any
+}
+
+// loadedCredentials are the credentials loaded by
+// LoadCredentials; they don't change while builds run.
+var loadedCredentials credentialConfig
@@ -0,0 +1,173 @@
+package buildworker
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, knownHosts := filepath.Join(dir, "key"), filepath.Join(dir, "known_hosts")
+	for _, file := range []string{key, knownHosts} {
+		err := ioutil.WriteFile(file, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldFile, oldSandbox := CredentialsFile, Sandbox
+	defer func() {
+		CredentialsFile, Sandbox = oldFile, oldSandbox
+		LoadCredentials()
+	}()
+	CredentialsFile = filepath.Join(dir, "credentials.json")
+	Sandbox = SandboxNamespaces
+
+	auth := base64.StdEncoding.EncodeToString([]byte("git:secret"))
+	auth2 := base64.StdEncoding.EncodeToString([]byte("bot:other"))
+	for i, test := range []struct {
+		json         string
+		mode         os.FileMode
+		sandbox      string
+		expectEnv    []string // without GIT_SSH_COMMAND
+		expectConfig string   // contents of the ssh_config, if any
+		shouldErr    bool
+	}{
+		{
+			json:      `{}`,
+			expectEnv: []string{"GIT_TERMINAL_PROMPT=0"},
+		},
+		{
+			json: `{"b.example": {"token": "secret"}, "a.example:8443": {"username": "bot", "token": "other"}}`,
+			expectEnv: []string{
+				"GIT_TERMINAL_PROMPT=0",
+				"GIT_CONFIG_COUNT=2",
+				"GIT_CONFIG_KEY_0=http.https://a.example:8443/.extraHeader",
+				"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth2,
+				"GIT_CONFIG_KEY_1=http.https://b.example/.extraHeader",
+				"GIT_CONFIG_VALUE_1=Authorization: Basic " + auth,
+			},
+		},
+		{
+			json:      `{"git.example:2222": {"ssh_key": ` + strconv.Quote(key) + `, "known_hosts": ` + strconv.Quote(knownHosts) + `}}`,
+			expectEnv: []string{"GIT_TERMINAL_PROMPT=0"},
+			expectConfig: "Host git.example\n" +
+				"\tIdentityFile " + strconv.Quote(key) + "\n" +
+				"\tIdentitiesOnly yes\n" +
+				"\tUserKnownHostsFile " + strconv.Quote(knownHosts) + "\n" +
+				"\tStrictHostKeyChecking yes\n",
+		},
+		{
+			json:      `{"a.example": {"token": "secret"}}`,
+			mode:      0644,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {"token": "secret"}}`,
+			sandbox:   "none",
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example/path": {"token": "secret"}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {"ssh_key": ` + strconv.Quote(key) + `}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {"ssh_key": "key", "known_hosts": ` + strconv.Quote(knownHosts) + `}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {"ssh_key": ` + strconv.Quote(filepath.Join(dir, "missing")) + `, "known_hosts": ` + strconv.Quote(knownHosts) + `}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `{"a.example": {"ssh_key": "/etc/hostname", "known_hosts": ` + strconv.Quote(knownHosts) + `}}`,
+			shouldErr: true,
+		},
+		{
+			json:      `not json`,
+			shouldErr: true,
+		},
+	} {
+		mode := test.mode
+		if mode == 0 {
+			mode = 0600
+		}
+		os.Remove(CredentialsFile)
+		err := ioutil.WriteFile(CredentialsFile, []byte(test.json), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Sandbox = SandboxNamespaces
+		if test.sandbox != "" {
+			Sandbox = test.sandbox
+		}
+
+		err = LoadCredentials()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+
+		env := loadedCredentials.env
+		if test.expectConfig == "" {
+			if !reflect.DeepEqual(env, test.expectEnv) {
+				t.Errorf("Test %d: Expected env %q, got %q", i, test.expectEnv, env)
+			}
+			continue
+		}
+		sshCommand := env[len(env)-1]
+		if !reflect.DeepEqual(env[:len(env)-1], test.expectEnv) {
+			t.Errorf("Test %d: Expected env %q, got %q", i, test.expectEnv, env[:len(env)-1])
+		}
+		configDir := loadedCredentials.paths[len(loadedCredentials.paths)-1]
+		configFile := filepath.Join(configDir, "ssh_config")
+		if sshCommand != "GIT_SSH_COMMAND=ssh -F "+strconv.Quote(configFile)+" -o BatchMode=yes" {
+			t.Errorf("Test %d: Unexpected SSH command: %s", i, sshCommand)
+		}
+		if !strings.HasPrefix(configDir, filepath.Join(os.TempDir(), "buildworker_credentials_")) {
+			t.Errorf("Test %d: Expected ssh_config in a new folder in the temporary directory, got %s", i, configDir)
+		}
+		if !reflect.DeepEqual(loadedCredentials.paths, []string{key, knownHosts, configDir}) {
+			t.Errorf("Test %d: Unexpected paths: %q", i, loadedCredentials.paths)
+		}
+		config, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			t.Errorf("Test %d: Reading ssh_config: %v", i, err)
+		} else if string(config) != test.expectConfig {
+			t.Errorf("Test %d: Expected ssh_config:\n%s\ngot:\n%s", i, test.expectConfig, config)
+		}
+
+		// loading again replaces the folder
+		err = LoadCredentials()
+		if err != nil {
+			t.Errorf("Test %d: Loading again: %v", i, err)
+		}
+		if _, err := os.Stat(configDir); !os.IsNotExist(err) {
+			t.Errorf("Test %d: Expected old ssh_config folder to be removed, got: %v", i, err)
+		}
+	}
+}
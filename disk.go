@@ -0,0 +1,136 @@
+package buildworker
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// These variables limit how much disk space builds may use,
+// so that a bloated or malicious repository cannot fill the
+// disk while it is copied into a temporary GOPATH or while
+// its dependencies are downloaded.
+var (
+	// DiskQuota is the number of bytes that the temporary
+	// GOPATH and the outputs of each build environment may
+	// use. Copying repositories into the temporary GOPATH
+	// stops once it is exceeded, commands are killed soon
+	// after it is exceeded while they run (see
+	// watchDiskQuota), and no more commands are run once it
+	// is found to be exceeded in between. Zero means no limit.
+	DiskQuota int64
+
+	// MinFreeSpace is the number of bytes that must be free
+	// on the file systems of the temporary directory and the
+	// master GOPATH for a new build environment to be opened.
+	// Zero disables the check.
+	MinFreeSpace int64
+)
+
+// errDiskQuota is the error returned when a build
+// environment uses more disk space than DiskQuota.
+var errDiskQuota = errors.New("disk quota exceeded")
+
+// diskBudget returns how many more bytes may be written to
+// the temporary GOPATH before DiskQuota is exceeded, or 0
+// if there is no quota. An error is returned if there is
+// no space left at all.
+func (be BuildEnv) diskBudget() (int64, error) {
+	if DiskQuota <= 0 {
+		return 0, nil
+	}
+	used := dirSize(be.tmpGopath)
+	if used >= DiskQuota {
+		return 0, fmt.Errorf("temporary GOPATH uses %d bytes: %v", used, errDiskQuota)
+	}
+	return DiskQuota - used, nil
+}
+
+// watchDiskQuota measures the temporary GOPATH every
+// diskQuotaInterval while cmd (which must have been started)
+// runs, or less often if measuring it takes long, and kills
+// cmd, along with the processes in its session if it has
+// one, once the GOPATH is over DiskQuota.
+// The returned function must be called when cmd is done;
+// it returns true if cmd was killed.
+func (be BuildEnv) watchDiskQuota(cmd *exec.Cmd) func() bool {
+	if DiskQuota <= 0 || be.tmpGopath == "" {
+		return func() bool { return false }
+	}
+	var (
+		mu       sync.Mutex
+		done     bool
+		exceeded bool
+		stop     = make(chan struct{})
+	)
+	go func() {
+		interval := diskQuotaInterval
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			// a large GOPATH takes a while to walk; spend
+			// no more than a tenth of the time doing that
+			start := time.Now()
+			size := dirSize(be.tmpGopath)
+			if took := time.Since(start); 10*took > diskQuotaInterval {
+				interval = 10 * took
+			}
+			if size <= DiskQuota {
+				continue
+			}
+			mu.Lock()
+			if !done {
+				exceeded = true
+				if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setsid {
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				} else {
+					cmd.Process.Kill()
+				}
+			}
+			mu.Unlock()
+			return
+		}
+	}()
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			done = true
+			close(stop)
+		}
+		return exceeded
+	}
+}
+
+// diskQuotaInterval is how often the size of the temporary
+// GOPATH is measured, at most, while a command runs (see
+// watchDiskQuota).
+var diskQuotaInterval = 2 * time.Second
+
+// checkFreeSpace returns an error if any of the file systems
+// of paths has less than MinFreeSpace bytes free. File systems
+// whose free space cannot be determined are not checked.
+func checkFreeSpace(paths ...string) error {
+	if MinFreeSpace <= 0 {
+		return nil
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		free, err := freeSpace(path)
+		if err != nil {
+			continue
+		}
+		if free < MinFreeSpace {
+			return fmt.Errorf("refusing to start a build: only %d bytes free for %s (need %d)", free, path, MinFreeSpace)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package buildworker
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to
+// unprivileged users on the file system of path.
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
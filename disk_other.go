@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+import "fmt"
+
+// freeSpace returns an error, since determining
+// free space is only supported on Linux.
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("free space is unknown on this platform")
+}
@@ -0,0 +1,141 @@
+package buildworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// DeployDryRun is like Deploy, except that it leaves the
+// master GOPATH alone: `go get -u` updates a scratch GOPATH
+// layered over it instead, and the checks run against that.
+// The repositories that the update would change are listed
+// in the report. An error is returned if anything failed,
+// in which case the deploy would have failed as well.
+func (be BuildEnv) DeployDryRun(requiredPlatforms []Platform) error {
+	defer be.endPhase() // see gopathUsage
+	err := be.checkDeployable()
+	if err != nil {
+		return err
+	}
+
+	dry, unlockMaster, cleanup, err := be.scratchMaster()
+	if err != nil {
+		return fmt.Errorf("making scratch GOPATH: %v", err)
+	}
+	defer cleanup()
+
+	changes, err := dry.dryUpdate()
+	unlockMaster()
+	if err != nil {
+		return err
+	}
+	be.Report.Changes = changes
+
+	_, err = dry.RunPluginChecks(requiredPlatforms)
+	return err
+}
+
+// dryUpdate updates the scratch master GOPATH of dry
+// and returns the changes to its repositories.
+func (dry BuildEnv) dryUpdate() ([]RepoChange, error) {
+	before, err := dry.repoCommits()
+	if err != nil {
+		return nil, fmt.Errorf("recording commits before update: %v", err)
+	}
+	err = dry.UpdateMasterGopath()
+	if err != nil {
+		return nil, err
+	}
+	after, err := dry.repoCommits()
+	if err != nil {
+		return nil, fmt.Errorf("recording commits after update: %v", err)
+	}
+	return dry.describeChanges(diffCommits(before, after)), nil
+}
+
+// scratchMaster returns a copy of the build environment whose
+// master GOPATH is a scratch GOPATH in the temporary directory,
+// with the same src folder as the real master GOPATH, so that
+// changing it does not change the real one. If possible, the src
+// folder is an overlay file system on top of the real one; then
+// the real master GOPATH stays read-locked until unlockMaster is
+// called, so that it does not change underneath the overlay while
+// it is being updated (unlockMaster should be called right after;
+// holding the lock longer would keep builds from starting, and
+// later changes to the real master GOPATH only matter to the
+// checks). Otherwise, the src folder is a deep copy, and
+// unlockMaster does nothing. cleanup removes the scratch GOPATH.
+func (be BuildEnv) scratchMaster() (dry BuildEnv, unlockMaster, cleanup func(), err error) {
+	masterSrc := filepath.Join(be.masterGopath, "src")
+	dir, err := ioutil.TempDir("", "dryrun_gopath_")
+	if err != nil {
+		return be, nil, nil, err
+	}
+	releaseDir := UseDir(dir)
+	cleanups := []func(){releaseDir, func() { os.RemoveAll(dir) }}
+	cleanup = func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	dry = be
+	dry.masterGopath = dir
+
+	// commands that work on the master GOPATH
+	// run as its owner, so they need to own this
+	err = os.Chmod(dir, 0755)
+	if err == nil {
+		err = chown(dir, UidGid)
+	}
+	if err != nil {
+		cleanup()
+		return be, nil, nil, err
+	}
+	master := be.asMaster()
+	layers := filepath.Join(dir, "overlay")
+	upper, work := filepath.Join(layers, "upper"), filepath.Join(layers, "work")
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{upper, work, src} {
+		err := master.mkdirAllOwned(d)
+		if err != nil {
+			cleanup()
+			return be, nil, nil, err
+		}
+	}
+
+	rlock(be.masterGopath)
+	err = mountOverlay(masterSrc, upper, work, src)
+	if err == nil {
+		var once sync.Once
+		unlockMaster = func() { once.Do(func() { runlock(be.masterGopath) }) }
+		cleanups = append(cleanups, unlockMaster, func() {
+			err := unmount(src)
+			if err != nil {
+				be.log.Printf("unmounting scratch GOPATH: %v", err)
+			}
+		})
+		return dry, unlockMaster, cleanup, nil
+	}
+	defer runlock(be.masterGopath)
+
+	be.log.Printf("overlaying master GOPATH failed, copying it instead: %v", err)
+	var stats copyStats
+	err = deepCopy(deepCopyConfig{
+		Source:        masterSrc,
+		Dest:          src,
+		KeepSymLinks:  true,
+		PreserveOwner: true,
+		Workers:       runtime.NumCPU(),
+		Stats:         &stats,
+	})
+	if err != nil {
+		cleanup()
+		return be, nil, nil, fmt.Errorf("copying master GOPATH src: %v", err)
+	}
+	be.log.Printf("copied master GOPATH src: %s", stats)
+	return dry, func() {}, cleanup, nil
+}
@@ -0,0 +1,94 @@
+package buildworker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScratchMaster(t *testing.T) {
+	masterGopath, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(masterGopath)
+	repo := filepath.Join(masterGopath, "src", "example.com", "plugin")
+	err = os.MkdirAll(repo, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(repo, "plugin.go"), []byte("package plugin\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("plugin.go", filepath.Join(repo, "link.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logBuf := new(bytes.Buffer)
+	be := BuildEnv{masterGopath: masterGopath, uid: -1, Log: logBuf, log: log.New(logBuf, "", 0), Report: new(Report)}
+	dry, unlockMaster, cleanup, err := be.scratchMaster()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if dry.masterGopath == masterGopath || !strings.HasPrefix(filepath.Base(dry.masterGopath), "dryrun_gopath_") {
+		t.Errorf("Expected a scratch master GOPATH in the temporary directory, got %s", dry.masterGopath)
+	}
+	if !dirInUse(dry.masterGopath) {
+		t.Error("Expected the scratch master GOPATH to be in use")
+	}
+
+	// the scratch GOPATH starts out like the master GOPATH...
+	dryRepo := filepath.Join(dry.masterGopath, "src", "example.com", "plugin")
+	for i, test := range []struct {
+		file, expect string
+	}{
+		{file: "plugin.go", expect: "package plugin\n"},
+		{file: "link.go", expect: "package plugin\n"},
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(dryRepo, test.file))
+		if err != nil {
+			t.Errorf("Test %d (%s): Expected no error, got: %v", i, test.file, err)
+		} else if string(contents) != test.expect {
+			t.Errorf("Test %d (%s): Expected %q, got %q", i, test.file, test.expect, contents)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dryRepo, "link.go")); err != nil || target != "plugin.go" {
+		t.Errorf("Expected link.go to be a link to plugin.go, got %q, %v", target, err)
+	}
+
+	// ...but changing it leaves the master GOPATH alone
+	unlockMaster()
+	unlockMaster() // may be called more than once
+	err = ioutil.WriteFile(filepath.Join(dryRepo, "plugin.go"), []byte("package changed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dryRepo, "new.go"), []byte("package plugin\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(repo, "plugin.go")); err != nil || string(contents) != "package plugin\n" {
+		t.Errorf("Expected the master GOPATH to be unchanged, got %q, %v", contents, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "new.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected no new file in the master GOPATH, got: %v", err)
+	}
+
+	// the master GOPATH is no longer read-locked, so it can be locked
+	lock(masterGopath)
+	unlock(masterGopath)
+
+	cleanup()
+	if _, err := os.Stat(dry.masterGopath); !os.IsNotExist(err) {
+		t.Errorf("Expected the scratch master GOPATH to be removed, got: %v", err)
+	}
+	if dirInUse(dry.masterGopath) {
+		t.Error("Expected the scratch master GOPATH to no longer be in use")
+	}
+}
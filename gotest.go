@@ -0,0 +1,308 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runGoTest runs `go test -json -race` with args from the
+// directory dir, and adds the results of the tests to the
+// report. source describes whose tests are being run and
+// retry is the number of the retry (0 for the first run).
+func (be BuildEnv) runGoTest(dir, source string, retry int, args ...string) ([]TestResult, error) {
+	results := newTestJSONWriter(source, retry, be.Log)
+	cmd := be.newCommand(classUntrusted, "go", append([]string{"test", "-json", "-race"}, args...)...)
+	cmd.Dir = dir
+	cmd.Stdout = results
+	err := be.runCommand(cmd)
+	results.Close()
+	be.Report.Tests = append(be.Report.Tests, results.results...)
+	if err != nil {
+		return results.results, fmt.Errorf("%v%s", err, testFailureSummary(failedTests(results.results)))
+	}
+	return results.results, nil
+}
+
+// goTestWithRetries runs goTest and, if tests fail, re-runs
+// only the failing tests up to TestRetries times. Tests that
+// pass on a retry are flaky; they are added to the report
+// and, unless FailOnFlakyTests is set, do not cause an error.
+// Retries are not possible if a package failed on its own
+// (for example, if it did not compile).
+func (be BuildEnv) goTestWithRetries(pkg, coverProfile string) error {
+	results, err := be.goTest(pkg, coverProfile)
+	if err == nil || TestRetries < 1 {
+		return err
+	}
+
+	failing, ok := failingTopLevelTests(results)
+	if !ok {
+		return err
+	}
+
+	var flaky []string
+	for retry := 1; retry <= TestRetries && len(failing) > 0; retry++ {
+		for testPkg, tests := range failing {
+			be.log.Printf("retry %d of %d failing test(s) in %s", retry, len(tests), testPkg)
+			runPattern := "^(" + strings.Join(tests, "|") + ")$"
+			retryResults, _ := be.runGoTest(be.TemporaryPath(testPkg), testSource(pkg), retry, "-run", runPattern, ".")
+			var remaining []string
+			for _, test := range tests {
+				if passed(retryResults, testPkg, test) {
+					flaky = append(flaky, testPkg+"."+test)
+				} else {
+					remaining = append(remaining, test)
+				}
+			}
+			if len(remaining) == 0 {
+				delete(failing, testPkg)
+			} else {
+				failing[testPkg] = remaining
+			}
+		}
+	}
+
+	sort.Strings(flaky)
+	be.Report.FlakyTests = append(be.Report.FlakyTests, flaky...)
+	if len(flaky) > 0 {
+		be.log.Printf("flaky tests: %s", strings.Join(flaky, ", "))
+	}
+
+	if len(failing) > 0 {
+		return err
+	}
+	if FailOnFlakyTests {
+		return fmt.Errorf("flaky tests: %s", strings.Join(flaky, ", "))
+	}
+	return nil
+}
+
+// failingTopLevelTests returns the names of the top-level
+// tests (subtests are run by their parent) in results which
+// failed, by package, quoted for use in a -run pattern. If a
+// package failed without any failing tests, ok is false.
+func failingTopLevelTests(results []TestResult) (failing map[string][]string, ok bool) {
+	failing = make(map[string][]string)
+	for _, r := range results {
+		if r.Action != "fail" {
+			continue
+		}
+		if r.Test == "" {
+			if !hasFailedTest(results, r.Package) {
+				return failing, false
+			}
+			continue
+		}
+		test := regexp.QuoteMeta(strings.SplitN(r.Test, "/", 2)[0])
+		if !contains(failing[r.Package], test) {
+			failing[r.Package] = append(failing[r.Package], test)
+		}
+	}
+	return failing, true
+}
+
+// passed returns true if the top-level test, quoted
+// as by failingTopLevelTests, passed in results.
+func passed(results []TestResult, pkg, test string) bool {
+	for _, r := range results {
+		if r.Package == pkg && regexp.QuoteMeta(r.Test) == test {
+			return r.Action == "pass"
+		}
+	}
+	return false
+}
+
+// contains returns true if list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// testSource describes whose tests are
+// the tests of pkg; see TestResult.
+func testSource(pkg string) string {
+	if pkg == CaddyPackage {
+		return "caddy"
+	}
+	return "plugin"
+}
+
+// TestResult is the result of a single test, or of a whole
+// package if Test is empty, as reported by `go test -json`.
+type TestResult struct {
+	// Whose tests these are: "plugin" for a plugin's
+	// own tests, or "caddy" for Caddy's tests (which,
+	// during plugin checks, run with the plugin
+	// plugged in).
+	Source string `json:"source"`
+
+	Package string  `json:"package"`
+	Test    string  `json:"test,omitempty"`
+	Action  string  `json:"action"`  // pass, fail, or skip
+	Elapsed float64 `json:"elapsed"` // seconds
+
+	// Which retry of the test this is; 0 if this
+	// is the result of the first run.
+	Retry int `json:"retry,omitempty"`
+
+	// The output of the test. To keep reports small,
+	// it is only kept for tests that did not pass.
+	Output string `json:"output,omitempty"`
+}
+
+// testEvent is an event emitted by `go test -json`;
+// see `go doc cmd/test2json`.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// testJSONWriter is an io.Writer which decodes the output of
+// `go test -json` as it is written, collecting results and
+// copying the test output (not the JSON) to log, so that
+// the log reads as if -json was not used.
+type testJSONWriter struct {
+	source  string
+	retry   int
+	log     io.Writer
+	buf     []byte
+	outputs map[string]*bytes.Buffer // keyed by package and test
+	results []TestResult
+}
+
+func newTestJSONWriter(source string, retry int, log io.Writer) *testJSONWriter {
+	return &testJSONWriter{
+		source:  source,
+		retry:   retry,
+		log:     log,
+		outputs: make(map[string]*bytes.Buffer),
+	}
+}
+
+func (w *testJSONWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.handleLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close handles any final line without a newline.
+func (w *testJSONWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.handleLine(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *testJSONWriter) handleLine(line []byte) {
+	var ev testEvent
+	if err := json.Unmarshal(line, &ev); err != nil || ev.Action == "" {
+		// not an event; probably output from the go command
+		w.log.Write(line)
+		return
+	}
+
+	key := ev.Package + "\x00" + ev.Test
+	switch ev.Action {
+	case "output":
+		w.log.Write([]byte(ev.Output))
+		if w.outputs[key] == nil {
+			w.outputs[key] = new(bytes.Buffer)
+		}
+		w.outputs[key].WriteString(ev.Output)
+	case "pass", "fail", "skip":
+		result := TestResult{
+			Source:  w.source,
+			Package: ev.Package,
+			Test:    ev.Test,
+			Action:  ev.Action,
+			Elapsed: ev.Elapsed,
+			Retry:   w.retry,
+		}
+		if out, ok := w.outputs[key]; ok {
+			if ev.Action != "pass" {
+				result.Output = out.String()
+			}
+			delete(w.outputs, key)
+		}
+		w.results = append(w.results, result)
+	}
+}
+
+// failedTests returns the names of the tests in
+// results that failed, qualified by package.
+func failedTests(results []TestResult) []string {
+	var failed []string
+	for _, r := range results {
+		if r.Action != "fail" {
+			continue
+		}
+		if r.Test == "" {
+			// packages fail if any of their tests did,
+			// so only list packages that failed on
+			// their own (e.g. build errors)
+			if hasFailedTest(results, r.Package) {
+				continue
+			}
+			failed = append(failed, r.Package)
+			continue
+		}
+		failed = append(failed, r.Package+"."+r.Test)
+	}
+	return failed
+}
+
+// hasFailedTest returns true if any test
+// (not the package itself) in pkg failed.
+func hasFailedTest(results []TestResult, pkg string) bool {
+	for _, r := range results {
+		if r.Package == pkg && r.Test != "" && r.Action == "fail" {
+			return true
+		}
+	}
+	return false
+}
+
+// testFailureSummary formats failed for an error message.
+func testFailureSummary(failed []string) string {
+	if len(failed) == 0 {
+		return ""
+	}
+	return " (failed: " + strings.Join(failed, ", ") + ")"
+}
+
+// These variables control what happens when tests fail.
+// Some tests depend on timing or the network and may fail
+// only sometimes; these tests are considered flaky if they
+// pass when they are retried.
+var (
+	// TestRetries is how many times to re-run
+	// failing tests before they are considered
+	// to have failed; 0 disables retries.
+	TestRetries int
+
+	// FailOnFlakyTests causes tests which fail
+	// but pass on a retry to fail the checks.
+	FailOnFlakyTests bool
+)
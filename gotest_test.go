@@ -0,0 +1,109 @@
+package buildworker
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTestJSONWriter(t *testing.T) {
+	for i, test := range []struct {
+		writes        []string
+		expectLog     string
+		expectResults []TestResult
+	}{
+		{
+			writes:    []string{"go: downloading example.com/dep\n"},
+			expectLog: "go: downloading example.com/dep\n",
+		},
+		{
+			writes: []string{
+				`{"Action":"run","Package":"p","Test":"TestA"}` + "\n",
+				`{"Action":"output","Package":"p","Test":"TestA","Output":"=== RUN   TestA\n"}` + "\n",
+				`{"Action":"pass","Package":"p","Test":"TestA","Elapsed":0.5}` + "\n",
+			},
+			expectLog: "=== RUN   TestA\n",
+			expectResults: []TestResult{
+				{Source: "plugin", Package: "p", Test: "TestA", Action: "pass", Elapsed: 0.5, Retry: 1},
+			},
+		},
+		{
+			// events split across writes, and output kept
+			// only for tests that did not pass
+			writes: []string{
+				`{"Action":"output","Package":"p","Test":"TestB","Out`,
+				`put":"boom\n"}` + "\n" + `{"Action":"fail","Package":"p","Test":"TestB"}` + "\n",
+				`{"Action":"fail","Package":"p"}`,
+			},
+			expectLog: "boom\n",
+			expectResults: []TestResult{
+				{Source: "plugin", Package: "p", Test: "TestB", Action: "fail", Output: "boom\n", Retry: 1},
+				{Source: "plugin", Package: "p", Action: "fail", Retry: 1},
+			},
+		},
+	} {
+		var log bytes.Buffer
+		w := newTestJSONWriter("plugin", 1, &log)
+		for _, s := range test.writes {
+			n, err := w.Write([]byte(s))
+			if err != nil || n != len(s) {
+				t.Fatalf("Test %d: Write returned %d, %v", i, n, err)
+			}
+		}
+		w.Close()
+		if log.String() != test.expectLog {
+			t.Errorf("Test %d: Expected log %q, got %q", i, test.expectLog, log.String())
+		}
+		if !reflect.DeepEqual(w.results, test.expectResults) {
+			t.Errorf("Test %d: Expected results %+v, got %+v", i, test.expectResults, w.results)
+		}
+	}
+}
+
+func TestFailingTopLevelTests(t *testing.T) {
+	for i, test := range []struct {
+		results       []TestResult
+		expectFailing map[string][]string
+		expectOK      bool
+	}{
+		{
+			results:       []TestResult{{Package: "p", Action: "pass"}},
+			expectFailing: map[string][]string{},
+			expectOK:      true,
+		},
+		{
+			results: []TestResult{
+				{Package: "p", Test: "TestA/sub", Action: "fail"},
+				{Package: "p", Test: "TestA", Action: "fail"},
+				{Package: "p", Test: "TestB.x", Action: "fail"},
+				{Package: "p", Test: "TestC", Action: "pass"},
+				{Package: "p", Action: "fail"},
+				{Package: "q", Test: "TestD", Action: "fail"},
+				{Package: "q", Action: "fail"},
+			},
+			expectFailing: map[string][]string{
+				"p": {"TestA", `TestB\.x`},
+				"q": {"TestD"},
+			},
+			expectOK: true,
+		},
+		{
+			// a package that failed without a failing
+			// test (like a build failure) cannot be retried
+			results: []TestResult{
+				{Package: "p", Test: "TestA", Action: "pass"},
+				{Package: "p", Action: "fail"},
+			},
+			expectOK: false,
+		},
+	} {
+		failing, ok := failingTopLevelTests(test.results)
+		if ok != test.expectOK {
+			t.Errorf("Test %d: Expected ok=%v, got %v", i, test.expectOK, ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(failing, test.expectFailing) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expectFailing, failing)
+		}
+	}
+}
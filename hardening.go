@@ -0,0 +1,55 @@
+package buildworker
+
+// These variables configure an additional layer of hardening
+// for every command that is run. When enabled, each command
+// runs with no_new_privs set, with all capabilities dropped
+// (including from the bounding set), and with a seccomp filter
+// which only allows the system calls in the seccomp profile.
+// Hardening is only available on Linux, and seccomp filters
+// only on amd64.
+var (
+	// Hardening enables hardening of commands. It may be
+	// empty (disabled), HardeningOn (best-effort: whatever
+	// cannot be applied is skipped), or HardeningStrict
+	// (commands fail if any of it cannot be applied).
+	Hardening string
+
+	// SeccompProfile is the path to a JSON file with
+	// the list of system calls that commands may use,
+	// like {"allow": ["read", "write", ...]}. It must
+	// be readable by root before commands are jailed.
+	// If empty, a built-in profile appropriate for
+	// compiling and testing Go code is used.
+	SeccompProfile string
+)
+
+// Values for Hardening.
+const (
+	HardeningOn     = "on"
+	HardeningStrict = "strict"
+)
+
+// seccompProfile is the format of a seccomp profile file.
+type seccompProfile struct {
+	Allow []string `json:"allow"`
+}
+
+// seccompDenied is the set of system calls that the built-in
+// seccomp profile does not allow, even though they are known;
+// commands have no business changing their privileges or
+// namespaces, mounting things, or tracing other processes.
+var seccompDenied = map[string]bool{
+	"chroot":      true,
+	"mknod":       true,
+	"mknodat":     true,
+	"mount":       true,
+	"pivot_root":  true,
+	"ptrace":      true,
+	"setgid":      true,
+	"setgroups":   true,
+	"sethostname": true,
+	"setns":       true,
+	"setuid":      true,
+	"umount2":     true,
+	"unshare":     true,
+}
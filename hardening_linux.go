@@ -0,0 +1,237 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// CheckHardening returns an error if Hardening is
+// set but cannot be applied to commands.
+func CheckHardening() error {
+	switch Hardening {
+	case "":
+		return nil
+	case HardeningOn, HardeningStrict:
+	default:
+		return fmt.Errorf("unknown hardening mode: %s", Hardening)
+	}
+	if SeccompProfile != "" {
+		_, err := loadSeccompProfile(SeccompProfile)
+		if err != nil {
+			return err
+		}
+	}
+	out := new(bytes.Buffer)
+	be := BuildEnv{
+		masterGopath: os.Getenv("GOPATH"),
+		uid:          UidGid,
+		Log:          out,
+		log:          log.New(out, "", 0),
+		Report:       new(Report),
+	}
+	err := be.runCommand(be.newCommand(classUntrusted, "go", "version"))
+	if err != nil {
+		return fmt.Errorf("running hardened command: %v: %s", err, out.String())
+	}
+	return nil
+}
+
+// harden applies hardening to the current process (which
+// must be the sandbox helper, running on a locked thread)
+// according to spec, switching to spec.Uid along the way
+// if it is set. The seccomp filter and any error compiling
+// it are passed in, since the profile must be loaded before
+// the helper is jailed. In best-effort mode, failures are
+// ignored; in strict mode, the first one is returned.
+func (spec sandboxSpec) harden(filter []sockFilter, filterErr error) error {
+	check := func(what string, err error) error {
+		if err != nil && spec.Strict {
+			return fmt.Errorf("%s: %v", what, err)
+		}
+		return nil
+	}
+
+	if err := check("seccomp profile", filterErr); err != nil {
+		return err
+	}
+
+	// drop all capabilities from the bounding set so they
+	// can never be regained, even when executing as root
+	// (the namespaces sandbox has dropped them already)
+	for c := 0; ; c++ {
+		inSet, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBsetRead, uintptr(c), 0)
+		if errno == syscall.EINVAL {
+			break // no more capabilities
+		}
+		if errno == 0 && inSet == 0 {
+			continue
+		}
+		_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, prCapBsetDrop, uintptr(c), 0)
+		if errno != 0 {
+			if err := check("dropping bounding set", errno); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0)
+	if errno != 0 {
+		if err := check("setting no_new_privs", errno); err != nil {
+			return err
+		}
+	}
+
+	if spec.Uid > -1 {
+		err := syscall.Setgroups(nil)
+		if err == nil {
+			err = syscall.Setgid(spec.Uid)
+		}
+		if err == nil {
+			err = syscall.Setuid(spec.Uid)
+		}
+		if err != nil {
+			return fmt.Errorf("switching to uid %d: %v", spec.Uid, err)
+		}
+	}
+
+	// clear the remaining capabilities
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		if err := check("clearing capabilities", errno); err != nil {
+			return err
+		}
+	}
+	_, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0)
+	if errno != 0 && errno != syscall.EINVAL { // EINVAL: kernel without ambient capabilities
+		if err := check("clearing ambient capabilities", errno); err != nil {
+			return err
+		}
+	}
+
+	// install the seccomp filter last, since it may deny
+	// the system calls used to do all of the above
+	if filter != nil {
+		prog := struct {
+			len    uint16
+			filter *sockFilter
+		}{len: uint16(len(filter)), filter: &filter[0]}
+		_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+		runtime.KeepAlive(filter)
+		if errno != 0 {
+			if err := check("installing seccomp filter", errno); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadSeccompProfile loads the list of allowed system
+// calls from the profile file at path.
+func loadSeccompProfile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading seccomp profile: %v", err)
+	}
+	var profile seccompProfile
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("decoding seccomp profile: %v", err)
+	}
+	for _, name := range profile.Allow {
+		if _, ok := seccompSyscalls[name]; !ok {
+			return nil, fmt.Errorf("seccomp profile: unknown system call: %s", name)
+		}
+	}
+	return profile.Allow, nil
+}
+
+// seccompFilter compiles a BPF program which allows the
+// system calls in the profile at profilePath (or in the
+// built-in profile, if empty) and denies all others
+// with EPERM. System calls for other architectures kill
+// the process.
+func seccompFilter(profilePath string) ([]sockFilter, error) {
+	if seccompArch == 0 {
+		return nil, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+	}
+
+	var allowed []string
+	if profilePath != "" {
+		var err error
+		allowed, err = loadSeccompProfile(profilePath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for name := range seccompSyscalls {
+			if !seccompDenied[name] {
+				allowed = append(allowed, name)
+			}
+		}
+		sort.Strings(allowed)
+	}
+
+	filter := []sockFilter{
+		{code: bpfLD | bpfW | bpfABS, k: 4}, // seccomp_data.arch
+		{code: bpfJMP | bpfJEQ | bpfK, jt: 1, k: seccompArch},
+		{code: bpfRET | bpfK, k: seccompRetKillProcess},
+		{code: bpfLD | bpfW | bpfABS, k: 0}, // seccomp_data.nr
+	}
+	for _, name := range allowed {
+		filter = append(filter,
+			sockFilter{code: bpfJMP | bpfJEQ | bpfK, jf: 1, k: seccompSyscalls[name]},
+			sockFilter{code: bpfRET | bpfK, k: seccompRetAllow},
+		)
+	}
+	filter = append(filter, sockFilter{code: bpfRET | bpfK, k: seccompRetErrno | uint32(syscall.EPERM)})
+
+	return filter, nil
+}
+
+// sockFilter is a BPF instruction (struct sock_filter).
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+const (
+	prCapBsetRead        = 23
+	prCapBsetDrop        = 24
+	prSetSeccomp         = 22
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+
+	linuxCapabilityVersion3 = 0x20080522
+
+	seccompModeFilter     = 2
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	bpfLD  = 0x00
+	bpfW   = 0x00
+	bpfABS = 0x20
+	bpfJMP = 0x05
+	bpfJEQ = 0x10
+	bpfK   = 0x00
+	bpfRET = 0x06
+)
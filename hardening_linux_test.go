@@ -0,0 +1,98 @@
+package buildworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	if seccompArch == 0 {
+		t.Skip("seccomp filters are not supported on this architecture")
+	}
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profile := filepath.Join(dir, "profile.json")
+	err = ioutil.WriteFile(profile, []byte(`{"allow": ["read", "write"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := seccompRetErrno | uint32(syscall.EPERM)
+	for i, test := range []struct {
+		profile string
+		arch    uint32
+		syscall string
+		expect  uint32
+	}{
+		{profile: "", arch: seccompArch, syscall: "read", expect: seccompRetAllow},
+		{profile: "", arch: seccompArch, syscall: "mount", expect: denied},
+		{profile: "", arch: seccompArch, syscall: "ptrace", expect: denied},
+		{profile: "", arch: seccompArch + 1, syscall: "read", expect: seccompRetKillProcess},
+		{profile: profile, arch: seccompArch, syscall: "write", expect: seccompRetAllow},
+		{profile: profile, arch: seccompArch, syscall: "openat", expect: denied},
+	} {
+		filter, err := seccompFilter(test.profile)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		actual, err := runSockFilter(filter, test.arch, seccompSyscalls[test.syscall])
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if actual != test.expect {
+			t.Errorf("Test %d: Expected %s to return %#x, got %#x", i, test.syscall, test.expect, actual)
+		}
+	}
+
+	for i, contents := range []string{
+		`{"allow": ["no_such_call"]}`,
+		`not json`,
+	} {
+		err := ioutil.WriteFile(profile, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := seccompFilter(profile); err == nil {
+			t.Errorf("Bad profile %d: Expected an error, got none", i)
+		}
+	}
+}
+
+// runSockFilter runs the subset of BPF that seccompFilter
+// emits against a system call nr for arch, and returns
+// the value the filter returns.
+func runSockFilter(filter []sockFilter, arch, nr uint32) (uint32, error) {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.code {
+		case bpfLD | bpfW | bpfABS:
+			switch ins.k {
+			case 0:
+				acc = nr
+			case 4:
+				acc = arch
+			default:
+				return 0, fmt.Errorf("unexpected instruction %d: %+v", pc, ins)
+			}
+		case bpfJMP | bpfJEQ | bpfK:
+			if acc == ins.k {
+				pc += int(ins.jt)
+			} else {
+				pc += int(ins.jf)
+			}
+		case bpfRET | bpfK:
+			return ins.k, nil
+		default:
+			return 0, fmt.Errorf("unexpected instruction %d: %+v", pc, ins)
+		}
+	}
+	return 0, fmt.Errorf("filter does not return")
+}
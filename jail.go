@@ -0,0 +1,360 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// InitJail assembles a minimal jail at dir in which commands
+// can be run with Chroot: the Go toolchain, git (with its
+// helpers and the shared libraries they need), CA certificates,
+// the files needed to resolve host names, /tmp, and /dev/null.
+// Directories at the paths of the master GOPATH and of the
+// temporary directory are created and owned by uid (if not -1);
+// they must be bind-mounted from the host before the jail can
+// be used, since commands use the same paths inside the jail.
+// It can be run again to update an existing jail.
+func InitJail(dir string, uid int) error {
+	if dir == "" || dir == "/" {
+		return fmt.Errorf("jail directory must not be empty or the root")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// the Go toolchain (updating only what changed,
+	// if the jail was initialized before)
+	err = deepCopy(deepCopyConfig{
+		Source:       goRoot(),
+		Dest:         filepath.Join(dir, goRoot()),
+		SkipSymLinks: true,
+		Owner:        -1,
+		Incremental:  true,
+		Mirror:       true,
+		Workers:      runtime.NumCPU(),
+	})
+	if err != nil {
+		return fmt.Errorf("copying Go toolchain: %v", err)
+	}
+
+	// git and its helpers (like git-remote-https), along
+	// with the shared libraries that all of them need
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return err
+	}
+	executables := []string{git}
+	err = copyIntoJail(dir, git)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(git, "--exec-path").Output()
+	if err != nil {
+		return fmt.Errorf("getting git exec path: %v", err)
+	}
+	execPath := strings.TrimSpace(string(out))
+	err = deepCopy(deepCopyConfig{
+		Source: execPath,
+		Dest:   filepath.Join(dir, execPath),
+		Owner:  -1,
+		// git's builtins (like git-add) are links to git
+		// itself, and should not become copies of it; since
+		// the jail has the same layout, links still work
+		KeepSymLinks:  true,
+		KeepHardLinks: true,
+		Incremental:   true,
+		Mirror:        true,
+	})
+	if err != nil {
+		return fmt.Errorf("copying git helpers: %v", err)
+	}
+	err = filepath.Walk(execPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			executables = append(executables, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if dirExists(gitTemplates) {
+		err = deepCopy(deepCopyConfig{
+			Source: gitTemplates,
+			Dest:   filepath.Join(dir, gitTemplates),
+			Owner:  -1,
+		})
+		if err != nil {
+			return fmt.Errorf("copying git templates: %v", err)
+		}
+	}
+	libs := make(map[string]bool)
+	for _, executable := range executables {
+		paths, err := sharedLibraries(executable)
+		if err != nil {
+			return fmt.Errorf("finding shared libraries of %s: %v", executable, err)
+		}
+		for _, lib := range paths {
+			if libs[lib] {
+				continue
+			}
+			libs[lib] = true
+			err := copyIntoJail(dir, lib)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// CA certificates and the files needed to resolve host names
+	for _, file := range append(jailCACerts, jailEtcFiles...) {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		err := copyIntoJail(dir, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// /tmp and /dev/null
+	tmp := filepath.Join(dir, "tmp")
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, 0777|os.ModeSticky)
+	if err != nil {
+		return err
+	}
+	devNull := filepath.Join(dir, "dev", "null")
+	if _, err := os.Stat(devNull); os.IsNotExist(err) {
+		err := os.MkdirAll(filepath.Dir(devNull), 0755)
+		if err != nil {
+			return err
+		}
+		err = makeDevNull(devNull)
+		if err != nil {
+			return fmt.Errorf("making /dev/null: %v", err)
+		}
+	}
+
+	// mount points for the GOPATHs
+	for _, path := range []string{os.Getenv("GOPATH"), os.TempDir()} {
+		if path == "" {
+			continue
+		}
+		mountPoint := filepath.Join(dir, path)
+		err := os.MkdirAll(mountPoint, 0755)
+		if err != nil {
+			return err
+		}
+		err = chown(mountPoint, uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckJail checks that the jail at dir has everything that
+// commands need, then runs a trivial `go build` and `git init`
+// in it as uid (if not -1). The returned error describes
+// everything that is missing or does not work.
+func CheckJail(dir string, uid int) error {
+	var problems []string
+	missing := func(what, path string) {
+		problems = append(problems, fmt.Sprintf("missing %s: %s", what, path))
+	}
+
+	goCmd := filepath.Join(goRoot(), "bin", "go")
+	if _, err := os.Stat(filepath.Join(dir, goCmd)); err != nil {
+		missing("Go toolchain", goCmd)
+	}
+	git, err := exec.LookPath("git")
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("git is not installed: %v", err))
+	} else if _, err := os.Stat(filepath.Join(dir, git)); err != nil {
+		missing("git", git)
+	}
+	hasCerts := false
+	for _, file := range jailCACerts {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			hasCerts = true
+			break
+		}
+	}
+	if !hasCerts {
+		missing("CA certificates", strings.Join(jailCACerts, " or "))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "/etc/resolv.conf")); err != nil {
+		missing("DNS configuration", "/etc/resolv.conf")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "tmp")); err != nil || info.Mode()&os.ModeSticky == 0 || info.Mode().Perm() != 0777 {
+		missing("world-writable directory with sticky bit", "/tmp")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "dev", "null")); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		missing("device", "/dev/null")
+	}
+	mounted := func(path string) bool {
+		hostInfo, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		jailInfo, err := os.Stat(filepath.Join(dir, path))
+		return err == nil && os.SameFile(hostInfo, jailInfo)
+	}
+	if gopath := os.Getenv("GOPATH"); gopath != "" && !mounted(gopath) {
+		missing("bind mount of master GOPATH", gopath)
+	}
+	if !mounted(os.TempDir()) {
+		missing("bind mount of temporary directory", os.TempDir())
+		return jailProblems(dir, problems) // can't run commands without it
+	}
+
+	// try the commands in a temporary GOPATH
+	tmpGopath, err := newTemporaryGopath(uid)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpGopath)
+	be := BuildEnv{
+		masterGopath: os.Getenv("GOPATH"),
+		tmpGopath:    tmpGopath,
+	}
+	pkgDir := be.TemporaryPath("jailcheck")
+	err = os.MkdirAll(pkgDir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(pkgDir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{filepath.Join(tmpGopath, "src"), filepath.Dir(pkgDir), pkgDir, filepath.Join(pkgDir, "main.go")} {
+		if err := chown(path, uid); err != nil {
+			return err
+		}
+	}
+	run := func(command string, args ...string) {
+		var out bytes.Buffer
+		cmd := exec.Command(command, args...)
+		cmd.Dir = pkgDir
+		cmd.Env = append(be.commandEnv(), "CGO_ENABLED=0")
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: dir}
+		if uid > -1 {
+			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(uid)}
+		}
+		err := cmd.Run()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v: %s",
+				filepath.Base(command), strings.Join(args, " "), err, strings.TrimSpace(out.String())))
+		}
+	}
+	run(goCmd, "build", "-o", "jailcheck", ".")
+	if git != "" {
+		run(git, "init", "-q", ".")
+	}
+
+	return jailProblems(dir, problems)
+}
+
+// jailProblems returns an error listing the problems
+// found with the jail at dir, or nil if there are none.
+func jailProblems(dir string, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("jail %s is not usable:\n  %s", dir, strings.Join(problems, "\n  "))
+}
+
+// copyIntoJail copies the file at path (following
+// symbolic links) to the same path inside the jail at
+// dir, preserving its permissions.
+func copyIntoJail(dir, path string) error {
+	err := copyPlainFile(path, filepath.Join(dir, path))
+	if err != nil {
+		return fmt.Errorf("copying %s into jail: %v", path, err)
+	}
+	return nil
+}
+
+// copyPlainFile copies the file at src (following symbolic
+// links) to dest, making any folders it needs and preserving
+// its permissions.
+func copyPlainFile(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destFile, srcFile)
+	if err != nil {
+		destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// goRoot returns the GOROOT of the go command in PATH.
+func goRoot() string {
+	goRootOnce.Do(func() {
+		out, err := exec.Command("go", "env", "GOROOT").Output()
+		if err == nil {
+			goRootPath = strings.TrimSpace(string(out))
+		}
+		if goRootPath == "" {
+			goRootPath = runtime.GOROOT()
+		}
+	})
+	return goRootPath
+}
+
+var (
+	goRootPath string
+	goRootOnce sync.Once
+)
+
+// jailCACerts are the usual locations of CA certificate
+// bundles; whichever exist are copied into jails.
+var jailCACerts = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, CentOS
+	"/etc/ssl/ca-bundle.pem",             // openSUSE
+	"/etc/ssl/cert.pem",                  // BSDs, macOS
+}
+
+// jailEtcFiles are files in /etc that are
+// copied into jails if they exist.
+var jailEtcFiles = []string{
+	"/etc/resolv.conf",
+	"/etc/hosts",
+	"/etc/nsswitch.conf",
+}
+
+// gitTemplates is the usual location of the
+// templates git uses to initialize repositories.
+const gitTemplates = "/usr/share/git-core/templates"
@@ -0,0 +1,44 @@
+package buildworker
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// makeDevNull creates the null device at path.
+func makeDevNull(path string) error {
+	const dev = 1<<8 | 3 // major 1, minor 3
+	err := syscall.Mknod(path, syscall.S_IFCHR|0666, dev)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, 0666) // not affected by umask
+}
+
+// sharedLibraries returns the paths of the shared libraries
+// (including the dynamic loader) that the executable at path
+// needs, according to ldd. Static executables need none.
+func sharedLibraries(path string) ([]string, error) {
+	out, err := exec.Command("ldd", path).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, nil // not a dynamic executable
+		}
+		return nil, err
+	}
+	var libs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// lines look like "libz.so.1 => /lib/x86_64-linux-gnu/libz.so.1 (0x...)"
+		// or "/lib64/ld-linux-x86-64.so.2 (0x...)"
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if strings.HasPrefix(field, "/") && (i == 0 || fields[i-1] == "=>") {
+				libs = append(libs, field)
+				break
+			}
+		}
+	}
+	return libs, nil
+}
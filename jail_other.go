@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+import "fmt"
+
+// makeDevNull returns an error, since the null device
+// has a different number on each platform; it must be
+// created by hand with mknod.
+func makeDevNull(path string) error {
+	return fmt.Errorf("create %s by hand with mknod on this platform", path)
+}
+
+// sharedLibraries returns no libraries, since finding
+// them is only supported on Linux. Executables that
+// need shared libraries must have them copied into
+// the jail by hand.
+func sharedLibraries(path string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,139 @@
+package buildworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// garbagePrefixes are the prefixes of the names of the
+// directories that the build worker creates in the
+// temporary directory, which are left behind if it
+// crashes while using them.
+var garbagePrefixes = []string{
+	"gopath_",                  // newTemporaryGopath
+	"caddy_build_",             // builds made for the HTTP API
+	"src_backup_",              // master GOPATH backups (before snapshots)
+	"dryrun_gopath_",           // scratchMaster
+	"buildworker_credentials_", // LoadCredentials
+}
+
+// CollectGarbage removes the directories left behind by
+// build environments and deploys that never finished (for
+// example, because the build worker crashed) if they were
+// last modified more than maxAge ago and are not in use
+// by this process. These are temporary GOPATHs, build
+// output folders, and backups in the temporary directory,
+// as well as old copies of the master GOPATH's src folder
+// left next to it by restores. It returns the paths of the
+// directories that were removed and how many bytes were
+// reclaimed. If an error is returned, some directories
+// may not have been removed.
+func CollectGarbage(maxAge time.Duration) ([]string, int64, error) {
+	var candidates []string
+	entries, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range entries {
+		for _, prefix := range garbagePrefixes {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+				candidates = append(candidates, filepath.Join(os.TempDir(), entry.Name()))
+				break
+			}
+		}
+	}
+	removed, reclaimed, err := removeGarbage(candidates, maxAge)
+	if err != nil {
+		return removed, reclaimed, err
+	}
+
+	// copies of src set aside by restores (which older
+	// versions did instead of restoring in place); they
+	// are only garbage if a new src folder was put in place
+	masterGopath := os.Getenv("GOPATH")
+	if masterGopath == "" {
+		return removed, reclaimed, nil
+	}
+	lock(masterGopath)
+	defer unlock(masterGopath)
+	if !dirExists(filepath.Join(masterGopath, "src")) {
+		return removed, reclaimed, nil
+	}
+	entries, err = ioutil.ReadDir(masterGopath)
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	candidates = nil
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "src_tmp_") {
+			candidates = append(candidates, filepath.Join(masterGopath, entry.Name()))
+		}
+	}
+	moreRemoved, moreReclaimed, err := removeGarbage(candidates, maxAge)
+	return append(removed, moreRemoved...), reclaimed + moreReclaimed, err
+}
+
+// removeGarbage removes the directories in candidates that
+// were last modified more than maxAge ago and are not in
+// use. It returns the directories that were removed and
+// how many bytes were reclaimed.
+func removeGarbage(candidates []string, maxAge time.Duration) ([]string, int64, error) {
+	var removed []string
+	var reclaimed int64
+	var errs []string
+	for _, dir := range candidates {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < maxAge || dirInUse(dir) {
+			continue
+		}
+		size := dirSize(dir)
+		err = os.RemoveAll(dir)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		removed = append(removed, dir)
+		reclaimed += size
+	}
+	if len(errs) > 0 {
+		return removed, reclaimed, fmt.Errorf("removing garbage: %s", strings.Join(errs, "; "))
+	}
+	return removed, reclaimed, nil
+}
+
+// UseDir marks dir as being in use by this process, so
+// that CollectGarbage does not remove it no matter how old
+// it is. The returned function must be called when dir is
+// no longer in use.
+func UseDir(dir string) func() {
+	dirsInUse.Lock()
+	dirsInUse.dirs[dir]++
+	dirsInUse.Unlock()
+	return func() {
+		dirsInUse.Lock()
+		dirsInUse.dirs[dir]--
+		if dirsInUse.dirs[dir] <= 0 {
+			delete(dirsInUse.dirs, dir)
+		}
+		dirsInUse.Unlock()
+	}
+}
+
+// dirInUse returns true if dir is marked as being in use.
+func dirInUse(dir string) bool {
+	dirsInUse.Lock()
+	defer dirsInUse.Unlock()
+	return dirsInUse.dirs[dir] > 0
+}
+
+// dirsInUse counts the uses of directories that
+// must not be removed by CollectGarbage.
+var dirsInUse = struct {
+	sync.Mutex
+	dirs map[string]int
+}{dirs: make(map[string]int)}
@@ -0,0 +1,121 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpDir, masterGopath := filepath.Join(dir, "tmp"), filepath.Join(dir, "gopath")
+	err = os.MkdirAll(filepath.Join(masterGopath, "src"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(tmpDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldTmpDir, oldGopath := os.Getenv("TMPDIR"), os.Getenv("GOPATH")
+	defer func() {
+		os.Setenv("TMPDIR", oldTmpDir)
+		os.Setenv("GOPATH", oldGopath)
+	}()
+	os.Setenv("TMPDIR", tmpDir)
+	os.Setenv("GOPATH", masterGopath)
+
+	const maxAge = time.Hour
+	tests := []struct {
+		path          string
+		file          bool
+		age           time.Duration
+		inUse         bool
+		expectRemoved bool
+	}{
+		{path: "tmp/gopath_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "tmp/caddy_build_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "tmp/src_backup_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "tmp/dryrun_gopath_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "tmp/buildworker_credentials_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "tmp/gopath_2", age: maxAge / 2, expectRemoved: false},
+		{path: "tmp/gopath_3", age: 2 * maxAge, inUse: true, expectRemoved: false},
+		{path: "tmp/gopath_4", file: true, age: 2 * maxAge, expectRemoved: false},
+		{path: "tmp/buildworker_sandbox", age: 2 * maxAge, expectRemoved: false},
+		{path: "tmp/other_gopath_1", age: 2 * maxAge, expectRemoved: false},
+		{path: "gopath/src_tmp_1", age: 2 * maxAge, expectRemoved: true},
+		{path: "gopath/src_tmp_2", age: maxAge / 2, expectRemoved: false},
+		{path: "gopath/src_backup_1", age: 2 * maxAge, expectRemoved: false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(test.path))
+		if test.file {
+			err = ioutil.WriteFile(path, []byte("garbage"), 0644)
+		} else {
+			err = os.Mkdir(path, 0755)
+			if err == nil {
+				err = ioutil.WriteFile(filepath.Join(path, "file"), []byte("garbage"), 0644)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-test.age)
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.inUse {
+			defer UseDir(path)()
+		}
+	}
+
+	removed, reclaimed, err := CollectGarbage(maxAge)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	wasRemoved := make(map[string]bool)
+	for _, path := range removed {
+		wasRemoved[path] = true
+	}
+	var expectReclaimed int64
+	for i, test := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(test.path))
+		if wasRemoved[path] != test.expectRemoved {
+			t.Errorf("Test %d (%s): Expected removed to be %v, got %v", i, test.path, test.expectRemoved, wasRemoved[path])
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) != test.expectRemoved {
+			t.Errorf("Test %d (%s): Expected it to exist to be %v, got: %v", i, test.path, !test.expectRemoved, err)
+		}
+		if test.expectRemoved {
+			expectReclaimed += int64(len("garbage"))
+		}
+	}
+	if reclaimed != expectReclaimed {
+		t.Errorf("Expected %d bytes reclaimed, got %d", expectReclaimed, reclaimed)
+	}
+
+	// copies of src are only garbage while there is a src folder
+	err = os.Chtimes(filepath.Join(masterGopath, "src_tmp_2"), time.Now().Add(-2*maxAge), time.Now().Add(-2*maxAge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(masterGopath, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, _, err = CollectGarbage(maxAge)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Expected nothing to be removed without a src folder, got %v", removed)
+	}
+}
@@ -0,0 +1,117 @@
+package buildworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CheckMasterGopath returns an error if the master GOPATH
+// (from environment) is not in a consistent state: if it
+// is being restored to a snapshot, or if a restore did not
+// finish (because it failed, or the build worker died).
+// Builds and deploys are refused until the restore is
+// finished, by ResumeRestore or RestoreSnapshot.
+func CheckMasterGopath() error {
+	masterGopath := os.Getenv("GOPATH")
+	if masterGopath == "" {
+		return nil
+	}
+	journal, err := loadRestoreJournal(masterGopath)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		return fmt.Errorf("master GOPATH is inconsistent: restoring it to snapshot %s (started %s) has not finished; %d repositories restored so far",
+			journal.Snapshot, journal.Started.Format(time.RFC3339), len(journal.Restored))
+	}
+	return nil
+}
+
+// ResumeRestore finishes restoring the master GOPATH (from
+// environment) to a snapshot if a restore was interrupted,
+// skipping the repositories that were already restored. It
+// returns the ID of the snapshot (or "" if there was nothing
+// to resume) and the log of the commands it ran.
+func ResumeRestore() (string, string, error) {
+	masterGopath := os.Getenv("GOPATH")
+	if masterGopath == "" {
+		return "", "", nil
+	}
+	journal, err := loadRestoreJournal(masterGopath)
+	if err != nil || journal == nil {
+		return "", "", err
+	}
+	be, err := newMasterEnv()
+	if err != nil {
+		return "", "", err
+	}
+	be.log.Printf("resuming restore of master GOPATH to snapshot %s, started %s",
+		journal.Snapshot, journal.Started.Format(time.RFC3339))
+	err = be.restoreSnapshot(journal.Snapshot)
+	return journal.Snapshot, be.Log.String(), err
+}
+
+// restoreJournal records the progress of restoring the master
+// GOPATH to a snapshot. It is saved before the restore starts
+// and after every repository, and deleted once it is done,
+// so its existence means the master GOPATH is inconsistent.
+type restoreJournal struct {
+	Snapshot string    `json:"snapshot"`
+	Started  time.Time `json:"started"`
+	Restored []string  `json:"restored"` // repositories that are done
+}
+
+// loadRestoreJournal loads the restore journal of
+// masterGopath, or returns nil if there is none.
+func loadRestoreJournal(masterGopath string) (*restoreJournal, error) {
+	data, err := ioutil.ReadFile(filepath.Join(masterGopath, restoreJournalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	journal := new(restoreJournal)
+	err = json.Unmarshal(data, journal)
+	if err != nil {
+		return nil, fmt.Errorf("loading restore journal: %v", err)
+	}
+	return journal, nil
+}
+
+// save writes the journal to masterGopath, such that
+// it is either fully written or not at all, even if
+// the machine crashes.
+func (j *restoreJournal) save(masterGopath string) error {
+	data, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(masterGopath, restoreJournalFile)
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		return fmt.Errorf("saving restore journal: %v", err)
+	}
+	return nil
+}
+
+// restoreJournalFile is the name of the file in the master
+// GOPATH that records the progress of a restore.
+const restoreJournalFile = ".buildworker_restore.json"
@@ -0,0 +1,198 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestoreJournal(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	journal, err := loadRestoreJournal(gopath)
+	if err != nil || journal != nil {
+		t.Errorf("Expected no journal and no error before one is saved, got %+v and %v", journal, err)
+	}
+
+	for i, test := range []restoreJournal{
+		{Snapshot: "a", Started: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Snapshot: "a", Started: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), Restored: []string{"example.com/p"}},
+		{Snapshot: "b", Started: time.Date(2017, 2, 2, 3, 4, 5, 0, time.UTC), Restored: []string{"example.com/p", "example.com/q"}},
+	} {
+		err := test.save(gopath)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error saving, got: %v", i, err)
+			continue
+		}
+		actual, err := loadRestoreJournal(gopath)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error loading, got: %v", i, err)
+			continue
+		}
+		if actual == nil || !reflect.DeepEqual(*actual, test) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test, actual)
+		}
+		if _, err := os.Stat(filepath.Join(gopath, restoreJournalFile+".tmp")); !os.IsNotExist(err) {
+			t.Errorf("Test %d: Expected no temporary file to be left, got: %v", i, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(gopath, restoreJournalFile), []byte(`{"snapshot": `), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRestoreJournal(gopath); err == nil {
+		t.Error("Expected an error loading a corrupt journal, got none")
+	}
+}
+
+func TestCheckMasterGopath(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	oldGopath := os.Getenv("GOPATH")
+	defer os.Setenv("GOPATH", oldGopath)
+
+	os.Setenv("GOPATH", "")
+	if err := CheckMasterGopath(); err != nil {
+		t.Errorf("Expected no error without a master GOPATH, got: %v", err)
+	}
+
+	os.Setenv("GOPATH", gopath)
+	if err := CheckMasterGopath(); err != nil {
+		t.Errorf("Expected no error without a journal, got: %v", err)
+	}
+
+	journal := restoreJournal{Snapshot: "a", Started: time.Now().UTC(), Restored: []string{"example.com/p"}}
+	err = journal.save(gopath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMasterGopath(); err == nil {
+		t.Error("Expected an error with a journal, got none")
+	}
+
+	// nothing may use the master GOPATH meanwhile
+	if _, err := Open("master", nil); err == nil {
+		t.Error("Expected opening a build environment to fail with a journal, got no error")
+	}
+	if _, err := TakeSnapshot(""); err == nil {
+		t.Error("Expected taking a snapshot to fail with a journal, got no error")
+	}
+	if _, _, err := PruneMasterGopath(nil, 0); err == nil {
+		t.Error("Expected pruning to fail with a journal, got no error")
+	}
+}
+
+func TestRestoreSnapshotJournal(t *testing.T) {
+	started := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, test := range []struct {
+		journal       *restoreJournal // before the restore
+		expectErr     bool
+		expectJournal *restoreJournal // after the restore; nil if it is gone
+	}{
+		{
+			// every repository was restored already,
+			// so only the journal is left to remove
+			journal: &restoreJournal{Snapshot: "snap", Started: started,
+				Restored: []string{"example.com/gone", "example.com/missing"}},
+			expectJournal: nil,
+		},
+		{
+			// resuming skips example.com/gone, which
+			// would fail, but not example.com/missing
+			journal:       &restoreJournal{Snapshot: "snap", Started: started, Restored: []string{"example.com/gone"}},
+			expectErr:     true,
+			expectJournal: &restoreJournal{Snapshot: "snap", Started: started, Restored: []string{"example.com/gone"}},
+		},
+		{
+			// a restore to another snapshot starts over
+			journal:       &restoreJournal{Snapshot: "other", Started: started, Restored: []string{"example.com/gone", "example.com/missing"}},
+			expectErr:     true,
+			expectJournal: &restoreJournal{Snapshot: "snap"},
+		},
+		{
+			journal:       nil,
+			expectErr:     true,
+			expectJournal: &restoreJournal{Snapshot: "snap"},
+		},
+	} {
+		gopath, err := ioutil.TempDir("", "buildworker_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the repositories in the snapshot are not in the
+		// GOPATH and have no origin, so restoring them fails
+		snap := Snapshot{
+			ID:      "snap",
+			Created: started,
+			Repos: map[string]SnapshotRepo{
+				"example.com/gone":    {Commit: "abc"},
+				"example.com/missing": {Commit: "def"},
+			},
+		}
+		manifest, err := json.Marshal(snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.MkdirAll(filepath.Join(gopath, snapshotsFolder, snap.ID), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(gopath, snapshotsFolder, snap.ID, snapshotManifest), manifest, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.journal != nil {
+			err = test.journal.save(gopath)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		logBuf := new(bytes.Buffer)
+		be := BuildEnv{masterGopath: gopath, uid: -1, Log: logBuf, log: log.New(logBuf, "", 0), Report: new(Report)}
+		err = be.restoreSnapshot(snap.ID)
+		if test.expectErr && err == nil {
+			t.Errorf("Test %d: Expected an error, got none", i)
+		}
+		if !test.expectErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+
+		journal, err := loadRestoreJournal(gopath)
+		if err != nil {
+			t.Errorf("Test %d: Loading journal: %v", i, err)
+		} else if test.expectJournal == nil && journal != nil {
+			t.Errorf("Test %d: Expected the journal to be removed, got %+v", i, journal)
+		} else if test.expectJournal != nil {
+			if journal == nil {
+				t.Errorf("Test %d: Expected a journal, got none", i)
+			} else {
+				if test.expectJournal.Started.IsZero() {
+					// a new restore was started
+					if journal.Started.Equal(started) {
+						t.Errorf("Test %d: Expected a new start time, got %v", i, journal.Started)
+					}
+					journal.Started = time.Time{}
+				}
+				if !reflect.DeepEqual(journal, test.expectJournal) {
+					t.Errorf("Test %d: Expected journal %+v, got %+v", i, test.expectJournal, journal)
+				}
+			}
+		}
+		os.RemoveAll(gopath)
+	}
+}
@@ -0,0 +1,192 @@
+package buildworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LockFileRetention is how many lock files to keep (0 for
+// all); older ones are deleted when a new one is written.
+// Builds can only ask for the lock files that are kept,
+// and pruning keeps every repository that they pin.
+var LockFileRetention = 50
+
+// LockFile pins the commit of every repository in the master
+// GOPATH, as it was after a deploy. A build which requests a
+// lock file (see WithLock) checks out the same commits of the
+// dependencies of Caddy and the plugins, so that it produces
+// the same binary no matter how the master GOPATH changed since.
+type LockFile struct {
+	ID      string            `json:"id"`
+	Created time.Time         `json:"created"`
+	Deploy  string            `json:"deploy,omitempty"` // what was deployed
+	Commits map[string]string `json:"commits"`          // by repository, relative to the src folder
+}
+
+// writeLockFile records the commits of the repositories in
+// the master GOPATH of the build environment as a new lock
+// file for deploy, and returns it.
+func (be BuildEnv) writeLockFile(deploy string) (LockFile, error) {
+	commits, err := be.repoCommits()
+	if err != nil {
+		return LockFile{}, err
+	}
+	now := time.Now().UTC()
+	lf := LockFile{
+		ID:      timestampID(now),
+		Created: now,
+		Deploy:  deploy,
+		Commits: commits,
+	}
+	data, err := json.MarshalIndent(lf, "", "\t")
+	if err != nil {
+		return lf, err
+	}
+	dir := filepath.Join(be.masterGopath, lockFilesFolder)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return lf, err
+	}
+	file := filepath.Join(dir, lf.ID+".json")
+	err = ioutil.WriteFile(file+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		return lf, fmt.Errorf("saving lock file: %v", err)
+	}
+
+	// only keep the newest lock files
+	lfs, err := loadLockFiles(be.masterGopath)
+	if err != nil {
+		return lf, err
+	}
+	for i := LockFileRetention; LockFileRetention > 0 && i < len(lfs); i++ {
+		err := os.Remove(filepath.Join(dir, lfs[i].ID+".json"))
+		if err != nil {
+			return lf, fmt.Errorf("deleting old lock file: %v", err)
+		}
+	}
+
+	return lf, nil
+}
+
+// loadLockFiles loads all the lock files of
+// masterGopath, newest first.
+func loadLockFiles(masterGopath string) ([]LockFile, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(masterGopath, lockFilesFolder))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lfs []LockFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		lf, err := loadLockFile(masterGopath, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		lfs = append(lfs, lf)
+	}
+	sort.Slice(lfs, func(i, j int) bool {
+		return lfs[i].Created.After(lfs[j].Created)
+	})
+	return lfs, nil
+}
+
+// loadLockFile loads the lock file of masterGopath
+// with the given ID.
+func loadLockFile(masterGopath, id string) (LockFile, error) {
+	var lf LockFile
+	if !validID(id) {
+		return lf, fmt.Errorf("invalid lock file ID: %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(masterGopath, lockFilesFolder, id+".json"))
+	if os.IsNotExist(err) {
+		return lf, fmt.Errorf("no lock file %s", id)
+	}
+	if err != nil {
+		return lf, err
+	}
+	err = json.Unmarshal(data, &lf)
+	if err != nil {
+		return lf, fmt.Errorf("loading lock file %s: %v", id, err)
+	}
+	return lf, nil
+}
+
+// pinDependencies checks out the commits in the lock file
+// of the build environment for every repository it lists,
+// except those of the packages of the build environment
+// (which are checked out at their requested versions).
+// Every one of them is copied into the temporary GOPATH,
+// where it shadows the one in the master GOPATH, even if that
+// is at the locked commit already: builds do not keep the
+// master GOPATH locked, so a deploy could move it before the
+// build is done. It returns the paths of the repositories it
+// copied from the master GOPATH. The master GOPATH must be
+// read-locked.
+func (be BuildEnv) pinDependencies() ([]string, error) {
+	lf, err := loadLockFile(be.masterGopath, be.lockFile)
+	if err != nil {
+		return nil, err
+	}
+	be.log.Printf("pinning dependencies to lock file %s", lf.ID)
+	be.Report.LockFile = lf.ID
+
+	own := make(map[string]bool)
+	for pkg := range be.pkgs {
+		own[be.repoOf(pkg)] = true
+	}
+	var repoPaths []string
+	for repo, commit := range lf.Commits {
+		if own[repo] {
+			continue
+		}
+		srcRepoPath := be.Path(repo)
+		destRepoPath := be.TemporaryRepoPath(srcRepoPath)
+		if !dirExists(srcRepoPath) {
+			return repoPaths, fmt.Errorf("repository %s is no longer in the master GOPATH", repo)
+		}
+		repoPaths = append(repoPaths, srcRepoPath)
+
+		if !dirExists(destRepoPath) {
+			var skip func(string, os.FileInfo) bool
+			if be.buildOnly {
+				skip = skipTestFiles
+			}
+			err = be.copyRepo(srcRepoPath, destRepoPath, skip)
+			if err != nil {
+				return repoPaths, fmt.Errorf("copying %s to %s: %v", srcRepoPath, destRepoPath, err)
+			}
+		}
+
+		// the commit may be one that the master GOPATH
+		// no longer has, if history was rewritten
+		err = be.gitCheckout(destRepoPath, commit)
+		if err != nil {
+			err = be.gitFetch(destRepoPath)
+			if err == nil {
+				err = be.gitCheckout(destRepoPath, commit)
+			}
+		}
+		if err != nil {
+			return repoPaths, fmt.Errorf("git checkout %s @ %s: %v", repo, commit, err)
+		}
+	}
+	return repoPaths, nil
+}
+
+// lockFilesFolder is the name of the folder in the master
+// GOPATH (outside of src) that lock files are kept in.
+const lockFilesFolder = ".buildworker_locks"
@@ -0,0 +1,130 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidID(t *testing.T) {
+	for i, test := range []struct {
+		id     string
+		expect bool
+	}{
+		{id: timestampID(time.Date(2017, 1, 2, 3, 4, 5, 6000, time.UTC)), expect: true},
+		{id: "20170102-030405.000006", expect: true},
+		{id: "", expect: false},
+		{id: ".", expect: false},
+		{id: "..", expect: false},
+		{id: ".hidden", expect: false},
+		{id: "../../etc/passwd", expect: false},
+		{id: "a/b", expect: false},
+		{id: `a\b`, expect: false},
+	} {
+		if actual := validID(test.id); actual != test.expect {
+			t.Errorf("Test %d (%q): Expected %v, got %v", i, test.id, test.expect, actual)
+		}
+	}
+}
+
+func TestLoadLockFile(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	dir := filepath.Join(gopath, lockFilesFolder)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"good.json": `{"id": "good", "created": "2017-01-02T03:04:05Z", "deploy": "example.com/p@v1",
+			"commits": {"example.com/p": "abc", "example.com/q": "def"}}`,
+		"bad.json": `{"id": `,
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, test := range []struct {
+		id        string
+		expect    LockFile
+		shouldErr bool
+	}{
+		{
+			id: "good",
+			expect: LockFile{
+				ID:      "good",
+				Created: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+				Deploy:  "example.com/p@v1",
+				Commits: map[string]string{"example.com/p": "abc", "example.com/q": "def"},
+			},
+		},
+		{id: "bad", shouldErr: true},
+		{id: "missing", shouldErr: true},
+		{id: "", shouldErr: true},
+		{id: "../" + lockFilesFolder + "/good", shouldErr: true},
+	} {
+		actual, err := loadLockFile(gopath, test.id)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d (%q): Expected an error, got none", i, test.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d (%q): Expected no error, got: %v", i, test.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d (%q): Expected %+v, got %+v", i, test.id, test.expect, actual)
+		}
+	}
+}
+
+func TestLoadLockFiles(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "buildworker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	lfs, err := loadLockFiles(gopath)
+	if err != nil || lfs != nil {
+		t.Errorf("Expected no lock files and no error without a lock files folder, got %v and %v", lfs, err)
+	}
+
+	dir := filepath.Join(gopath, lockFilesFolder)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"old.json":     `{"id": "old", "created": "2017-01-02T03:04:05Z"}`,
+		"new.json":     `{"id": "new", "created": "2017-03-02T03:04:05Z"}`,
+		"middle.json":  `{"id": "middle", "created": "2017-02-02T03:04:05Z"}`,
+		"new.json.tmp": `{"id": `,
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lfs, err = loadLockFiles(gopath)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var ids []string
+	for _, lf := range lfs {
+		ids = append(ids, lf.ID)
+	}
+	if expect := []string{"new", "middle", "old"}; !reflect.DeepEqual(ids, expect) {
+		t.Errorf("Expected lock files %v, got %v", expect, ids)
+	}
+}
@@ -0,0 +1,41 @@
+package buildworker
+
+// OpenOption is an option for opening a build environment.
+type OpenOption func(*openOptions)
+
+// openOptions holds the options a build
+// environment is opened with.
+type openOptions struct {
+	buildOnly bool
+	lockFile  string
+}
+
+// ForBuild opens a build environment which is only used to
+// build Caddy, not to run checks or tests. Test files and
+// test dependencies of plugins are not copied or downloaded,
+// which makes opening it faster. Caddy itself is always
+// copied in full, since the version compiled into it would
+// otherwise show modifications.
+func ForBuild() OpenOption {
+	return func(o *openOptions) {
+		o.buildOnly = true
+	}
+}
+
+// ForDeploy opens a build environment which can be used for
+// anything, including deploys and checks. This is the default.
+func ForDeploy() OpenOption {
+	return func(o *openOptions) {
+		o.buildOnly = false
+	}
+}
+
+// WithLock opens a build environment whose dependencies are
+// checked out at the commits in the lock file with the given
+// ID (as written by a deploy), instead of those that are in
+// the master GOPATH. An empty ID means no lock file.
+func WithLock(id string) OpenOption {
+	return func(o *openOptions) {
+		o.lockFile = id
+	}
+}
@@ -0,0 +1,273 @@
+package buildworker
+
+import (
+	"encoding/xml"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloneMasterRepo clones the repository at url into the
+// master GOPATH, at the root of the repository of pkg,
+// unless there is something at that path already: then
+// it is used as a cache of the repository, and url is
+// only fetched from in the temporary GOPATH (see
+// setOrigin). The master GOPATH must be locked.
+func (be BuildEnv) cloneMasterRepo(pkg, url string) error {
+	root, err := repoRootOf(pkg)
+	if err != nil {
+		return fmt.Errorf("finding repository root of %s: %v", pkg, err)
+	}
+	repoPath := be.Path(root)
+	if dirExists(repoPath) {
+		return nil
+	}
+	master := be.asMaster()
+	err = master.mkdirAllOwned(filepath.Dir(repoPath))
+	if err != nil {
+		return err
+	}
+	be.log.Printf("cloning %s from %s", pkg, url)
+	cmd := master.newCommand(classNetwork, "git", "clone", "--", url, repoPath)
+	err = be.runCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("git clone %s: %v", url, err)
+	}
+	err = checkPackage(be.Path(pkg), pkg)
+	if err != nil {
+		// don't let `go get` fetch something else
+		// into the path, or builds use it as a cache
+		os.RemoveAll(repoPath)
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return nil
+}
+
+// setOrigin points the origin remote of the repository
+// at repoPath to url, so that it is fetched from there.
+// This way, a fork or mirror can stand in for the
+// repository that the import path refers to.
+func (be BuildEnv) setOrigin(repoPath, url string) error {
+	class := classLocal
+	if strings.HasPrefix(repoPath, filepath.Join(be.masterGopath, "src")+string(filepath.Separator)) {
+		class = classNetwork // only these may write to the master GOPATH
+	}
+	cmd := be.newCommand(class, "git", "remote", "set-url", "origin", url)
+	cmd.Dir = repoPath
+	err := be.runCommand(cmd)
+	if err != nil {
+		// repositories copied from somewhere
+		// else might not have an origin
+		cmd = be.newCommand(class, "git", "remote", "add", "origin", url)
+		cmd.Dir = repoPath
+		err = be.runCommand(cmd)
+	}
+	return err
+}
+
+// checkPackage returns an error if the folder dir does
+// not contain the Go package pkg: it must have Go files
+// (other than tests) with a package clause that is not
+// for a command, and none of them may have an import
+// comment that gives a different import path.
+func checkPackage(dir, pkg string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, file, nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		if comment := importComment(fset, f.Name.Pos(), f.Comments); comment != "" && comment != pkg {
+			return fmt.Errorf("%s is package %s, not %s", filepath.Base(file), comment, pkg)
+		}
+		switch f.Name.Name {
+		case "main", "documentation":
+		default:
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("repository does not contain package %s", pkg)
+	}
+	return nil
+}
+
+// importComment returns the import path in the import
+// comment (like `package foo // import "example.com/foo"`)
+// among comments that is on the same line as the package
+// name at namePos, or an empty string if there is none.
+func importComment(fset *token.FileSet, namePos token.Pos, comments []*ast.CommentGroup) string {
+	line := fset.Position(namePos).Line
+	for _, group := range comments {
+		for _, c := range group.List {
+			if fset.Position(c.Pos()).Line != line {
+				continue
+			}
+			text := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(c.Text, "//"), "/*"))
+			text = strings.TrimSpace(strings.TrimSuffix(text, "*/"))
+			if !strings.HasPrefix(text, "import ") {
+				continue
+			}
+			path, err := strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(text, "import ")))
+			if err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// checkRepoURL returns an error if url is not a URL that
+// plugins may be cloned from: an https, ssh, or git URL,
+// or an scp-like address (user@host:path). Local paths
+// and git's other transports are not allowed.
+func checkRepoURL(url string) error {
+	if strings.HasPrefix(url, "-") || strings.Contains(url, "::") ||
+		strings.ContainsAny(url, " \t\r\n") {
+		return fmt.Errorf("invalid repository URL: %q", url)
+	}
+	if i := strings.Index(url, "://"); i > -1 {
+		switch url[:i] {
+		case "https", "ssh", "git":
+			return nil
+		}
+		return fmt.Errorf("unsupported scheme in repository URL: %q", url)
+	}
+	if scpLikeURL.MatchString(url) {
+		return nil
+	}
+	return fmt.Errorf("invalid repository URL: %q", url)
+}
+
+// repoRootOf returns the import path of the root of the
+// repository that contains pkg, like `go get` does: on
+// well-known code hosts, and if the path has an element
+// ending in ".git", it is known from the path alone (see
+// knownRepoRoot); otherwise, it is looked up from the
+// go-import meta tags at https://pkg?go-get=1.
+func repoRootOf(pkg string) (string, error) {
+	if root, ok := knownRepoRoot(pkg); ok {
+		return root, nil
+	}
+	client := &http.Client{Timeout: repoRootTimeout}
+	resp, err := client.Get("https://" + pkg + "?go-get=1")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	imports, err := parseMetaGoImports(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %v", resp.Request.URL, err)
+	}
+	for _, imp := range imports {
+		if imp.vcs == "git" && (pkg == imp.prefix || strings.HasPrefix(pkg, imp.prefix+"/")) {
+			return imp.prefix, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no go-import meta tag for a git repository containing %s", resp.Request.URL, pkg)
+}
+
+// repoRootTimeout is how long repoRootOf
+// waits for the meta tags of a package.
+var repoRootTimeout = 30 * time.Second
+
+// knownRepoRoot returns the import path of the root of the
+// repository that contains pkg if it can be told from the
+// path: on well-known code hosts it is the first three
+// elements of the path, and if the path has an element
+// ending in ".git", the root ends there.
+func knownRepoRoot(pkg string) (string, bool) {
+	parts := strings.Split(pkg, "/")
+	for i, part := range parts {
+		if i > 0 && strings.HasSuffix(part, ".git") {
+			return strings.Join(parts[:i+1], "/"), true
+		}
+	}
+	switch parts[0] {
+	case "github.com", "bitbucket.org", "gitlab.com":
+		if len(parts) >= 3 {
+			return strings.Join(parts[:3], "/"), true
+		}
+	}
+	return "", false
+}
+
+// metaImport is the content of a go-import meta tag.
+type metaImport struct {
+	prefix, vcs, repoURL string
+}
+
+// parseMetaGoImports returns the go-import meta tags in
+// the head of the HTML document in r, the same way that
+// `go get` finds them.
+func parseMetaGoImports(r io.Reader) ([]metaImport, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "ascii", "utf-8":
+			return input, nil
+		}
+		return nil, fmt.Errorf("can't decode XML document using charset %q", charset)
+	}
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var imports []metaImport
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(imports) > 0 {
+				return imports, nil
+			}
+			return nil, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			return imports, nil
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			return imports, nil
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+		if attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+		if f := strings.Fields(attrValue(e.Attr, "content")); len(f) == 3 {
+			imports = append(imports, metaImport{prefix: f[0], vcs: f[1], repoURL: f[2]})
+		}
+	}
+}
+
+// attrValue returns the value of the attribute
+// named name in attrs, or an empty string.
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// scpLikeURL matches the scp-like syntax
+// for SSH URLs that git understands.
+var scpLikeURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^/\\]`)
@@ -0,0 +1,190 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckRepoURL(t *testing.T) {
+	for i, test := range []struct {
+		url       string
+		shouldErr bool
+	}{
+		{url: "https://github.com/user/fork", shouldErr: false},
+		{url: "https://git.example.com/user/fork.git", shouldErr: false},
+		{url: "ssh://git@git.example.com:2222/user/fork.git", shouldErr: false},
+		{url: "git://git.example.com/user/fork", shouldErr: false},
+		{url: "git@github.com:user/fork.git", shouldErr: false},
+		{url: "", shouldErr: true},
+		{url: "http://github.com/user/fork", shouldErr: true},
+		{url: "file:///var/lib/repo", shouldErr: true},
+		{url: "ext::sh -c touch% /tmp/pwned", shouldErr: true},
+		{url: "fd::17", shouldErr: true},
+		{url: "--upload-pack=touch /tmp/pwned", shouldErr: true},
+		{url: "-oProxyCommand=evil", shouldErr: true},
+		{url: "https://github.com/user/fork\n", shouldErr: true},
+		{url: "/var/lib/repo", shouldErr: true},
+		{url: "../repo", shouldErr: true},
+		{url: "host:path", shouldErr: true},
+		{url: "git@host:/abs/path", shouldErr: true},
+	} {
+		err := checkRepoURL(test.url)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d (%q): Expected an error, got none", i, test.url)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d (%q): Expected no error, got: %v", i, test.url, err)
+		}
+	}
+}
+
+func TestKnownRepoRoot(t *testing.T) {
+	for i, test := range []struct {
+		pkg    string
+		expect string
+		known  bool
+	}{
+		{pkg: "github.com/user/plugin", expect: "github.com/user/plugin", known: true},
+		{pkg: "github.com/user/plugin/sub/pkg", expect: "github.com/user/plugin", known: true},
+		{pkg: "bitbucket.org/user/plugin/sub", expect: "bitbucket.org/user/plugin", known: true},
+		{pkg: "gitlab.com/user/plugin/sub", expect: "gitlab.com/user/plugin", known: true},
+		{pkg: "git.example.com/team/plugin.git/sub", expect: "git.example.com/team/plugin.git", known: true},
+		{pkg: "github.com/user/plugin.git/sub", expect: "github.com/user/plugin.git", known: true},
+		{pkg: "github.com/user", known: false},
+		{pkg: "git.example.com/team/repo/caddyplugin", known: false},
+		{pkg: "example.git/plugin", known: false},
+	} {
+		actual, known := knownRepoRoot(test.pkg)
+		if actual != test.expect || known != test.known {
+			t.Errorf("Test %d (%s): Expected %q (%v), got %q (%v)", i, test.pkg, test.expect, test.known, actual, known)
+		}
+	}
+}
+
+func TestParseMetaGoImports(t *testing.T) {
+	for i, test := range []struct {
+		html   string
+		expect []metaImport
+	}{
+		{
+			html: `<!DOCTYPE html><html><head>
+<meta charset="utf-8">
+<meta name="go-import" content="git.example.com/team/repo git https://git.example.com/team/repo.git">
+<meta name="go-source" content="git.example.com/team/repo _ _ _">
+</head><body>go get git.example.com/team/repo/caddyplugin</body></html>`,
+			expect: []metaImport{{prefix: "git.example.com/team/repo", vcs: "git", repoURL: "https://git.example.com/team/repo.git"}},
+		},
+		{
+			html: `<html><head><META NAME="go-import" CONTENT="example.com/a hg https://example.com/a"/>
+<meta name="go-import" content="example.com/b  git   https://example.com/b"></head></html>`,
+			expect: []metaImport{
+				{prefix: "example.com/a", vcs: "hg", repoURL: "https://example.com/a"},
+				{prefix: "example.com/b", vcs: "git", repoURL: "https://example.com/b"},
+			},
+		},
+		{
+			// only tags in the head count
+			html:   `<html><head></head><body><meta name="go-import" content="example.com/a git https://example.com/a"></body></html>`,
+			expect: nil,
+		},
+		{
+			html:   `<meta name="go-import" content="example.com/a git">`,
+			expect: nil,
+		},
+	} {
+		actual, err := parseMetaGoImports(strings.NewReader(test.html))
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expect, actual)
+		}
+	}
+}
+
+func TestCheckPackage(t *testing.T) {
+	for i, test := range []struct {
+		files     map[string]string
+		shouldErr bool
+	}{
+		{
+			files: map[string]string{"plugin.go": "package plugin\n"},
+		},
+		{
+			files: map[string]string{"plugin.go": "package plugin // import \"example.com/plugin\"\n"},
+		},
+		{
+			files: map[string]string{"plugin.go": "package plugin /* import \"example.com/plugin\" */\n"},
+		},
+		{
+			files: map[string]string{
+				"doc.go":    "// Package plugin does things.\n// It is not imported as \"example.com/other\".\npackage plugin\n",
+				"plugin.go": "package plugin\n\n// import \"example.com/other\"\nvar x int\n",
+			},
+		},
+		{
+			files:     map[string]string{"plugin.go": "package plugin // import \"example.com/other\"\n"},
+			shouldErr: true,
+		},
+		{
+			files:     map[string]string{"main.go": "package main\n"},
+			shouldErr: true,
+		},
+		{
+			files:     map[string]string{"plugin_test.go": "package plugin\n"},
+			shouldErr: true,
+		},
+		{
+			files:     map[string]string{"README.md": "package plugin\n"},
+			shouldErr: true,
+		},
+		{
+			files:     map[string]string{"plugin.go": "not go\n"},
+			shouldErr: true,
+		},
+	} {
+		dir, err := ioutil.TempDir("", "buildworker_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range test.files {
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = checkPackage(dir, "example.com/plugin")
+		os.RemoveAll(dir)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+}
+
+func TestScpLikeURL(t *testing.T) {
+	for i, test := range []struct {
+		url    string
+		expect bool
+	}{
+		{url: "git@github.com:user/repo.git", expect: true},
+		{url: "deploy.bot@git.example.com:repo", expect: true},
+		{url: "git@github.com:/user/repo.git", expect: false},
+		{url: `git@github.com:\repo`, expect: false},
+		{url: "github.com:user/repo.git", expect: false},
+		{url: "git@:repo", expect: false},
+		{url: "git@host", expect: false},
+		{url: "https://git@github.com:443/repo", expect: false},
+	} {
+		if actual := scpLikeURL.MatchString(test.url); actual != test.expect {
+			t.Errorf("Test %d (%q): Expected %v, got %v", i, test.url, test.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// registeredPlugins builds Caddy's main package for this
+// platform against the temporary GOPATH, with whatever plugins
+// are plugged in at the time, and runs it with -plugins to list
+// the plugins registered with Caddy. The result maps the name of
+// each category (e.g. a server type or "caddyfile_loaders") to
+// the plugin names in it. If this version of Caddy cannot list
+// its plugins (-plugins was added in Caddy 0.9), it returns nil.
+//
+// The binary runs the init functions of every plugged-in
+// plugin, so it is executed like any other untrusted code.
+func (be BuildEnv) registeredPlugins() (map[string][]string, error) {
+	binDir := filepath.Join(be.tmpGopath, "bin")
+	err := be.mkdirAllOwned(binDir)
+	if err != nil {
+		return nil, err
+	}
+	binaryPath := filepath.Join(binDir, "caddy_probe")
+	cmd := be.newCommand(classLocal, "go", "build", "-o", binaryPath)
+	cmd.Dir = filepath.Join(be.TemporaryPath(CaddyPackage), "caddy") // main() func is in this subfolder
+	cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	err = be.runCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("building caddy: %v", err)
+	}
+	defer os.Remove(binaryPath)
+
+	var out bytes.Buffer
+	cmd = be.newCommand(classUntrusted, binaryPath, "-plugins")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = be.runCommand(cmd)
+	if err != nil {
+		if strings.Contains(out.String(), "flag provided but not defined") {
+			be.log.Printf("this version of caddy cannot list its plugins")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("caddy -plugins: %v: %s", err, out.String())
+	}
+	return parsePluginList(out.String()), nil
+}
+
+// parsePluginList parses the output of `caddy -plugins`,
+// which lists plugins by category, like this:
+//
+//	Server types:
+//	  http
+//
+//	Other plugins:
+//	  http.basicauth
+//
+// Categories are named like "server_types"; other plugins
+// are listed under the name of their server type (if any,
+// otherwise under "other"), like caddy.ListPlugins() does.
+func parsePluginList(output string) map[string][]string {
+	plugins := make(map[string][]string)
+	var category string
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && strings.HasSuffix(name, ":") {
+			category = strings.ToLower(strings.TrimSuffix(name, ":"))
+			category = strings.TrimSuffix(category, " plugins")
+			category = strings.Replace(category, " ", "_", -1)
+			continue
+		}
+		if category == "" {
+			continue
+		}
+		cat := category
+		if cat == "other" {
+			if dot := strings.Index(name, "."); dot > -1 {
+				cat, name = name[:dot], name[dot+1:]
+			}
+		}
+		plugins[cat] = append(plugins[cat], name)
+	}
+	return plugins
+}
+
+// pluginsAdded returns the plugins that are in after
+// but not in before, formatted as "category/name".
+func pluginsAdded(before, after map[string][]string) []string {
+	var added []string
+	for category, names := range after {
+		existing := make(map[string]bool)
+		for _, name := range before[category] {
+			existing[name] = true
+		}
+		for _, name := range names {
+			if !existing[name] {
+				added = append(added, category+"/"+name)
+			}
+		}
+	}
+	sort.Strings(added)
+	return added
+}
+
+// pluginNames statically finds the names that the package
+// in dir registers with caddy.RegisterPlugin(). Only names
+// that are string literals or package-level constants with
+// literal values can be found.
+func pluginNames(dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, pkg := range pkgs {
+		consts := make(map[string]string)
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					vs := spec.(*ast.ValueSpec)
+					for i, name := range vs.Names {
+						if i < len(vs.Values) {
+							if val, ok := stringLiteral(vs.Values[i]); ok {
+								consts[name.Name] = val
+							}
+						}
+					}
+				}
+			}
+		}
+
+		for _, f := range pkg.Files {
+			caddyName := "caddy"
+			for _, imp := range f.Imports {
+				if path, _ := strconv.Unquote(imp.Path.Value); path == CaddyPackage && imp.Name != nil {
+					caddyName = imp.Name.Name
+				}
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) == 0 {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != "RegisterPlugin" {
+					return true
+				}
+				if x, ok := sel.X.(*ast.Ident); !ok || x.Name != caddyName {
+					return true
+				}
+				if name, ok := stringLiteral(call.Args[0]); ok {
+					names = append(names, name)
+				} else if ident, ok := call.Args[0].(*ast.Ident); ok && consts[ident.Name] != "" {
+					names = append(names, consts[ident.Name])
+				}
+				return true
+			})
+		}
+	}
+
+	return names, nil
+}
+
+// stringLiteral returns the value of expr if
+// it is a string literal.
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	val, err := strconv.Unquote(lit.Value)
+	return val, err == nil
+}
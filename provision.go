@@ -0,0 +1,259 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ProvisionStrategy is how repositories are copied from the
+// master GOPATH into temporary GOPATHs. The default (empty
+// string or ProvisionCopy) makes a deep copy of every file.
+// The other strategies are faster, but they only work in
+// some environments; if one fails, provisioning falls back
+// to a deep copy of the repository.
+var ProvisionStrategy string
+
+// Values for ProvisionStrategy.
+const (
+	// ProvisionCopy makes a deep copy of the repository.
+	ProvisionCopy = "copy"
+
+	// ProvisionClone runs `git clone --shared`, which
+	// shares the objects of the repository in the master
+	// GOPATH instead of copying them, and only checks out
+	// the files. (A git worktree would be similar, but it
+	// has to write to the repository in the master GOPATH.)
+	ProvisionClone = "clone"
+
+	// ProvisionHardlink links to the files of the repository
+	// in the master GOPATH instead of copying them, except
+	// for the git metadata that git modifies in place. Since
+	// the files are shared, commands must not be able to
+	// write to them, so this is only used with UidRange.
+	ProvisionHardlink = "hardlink"
+
+	// ProvisionReflink makes copies which share their blocks
+	// with the original files until they are modified. This
+	// needs a file system which supports it, like Btrfs or
+	// XFS, and is only available on Linux.
+	ProvisionReflink = "reflink"
+
+	// ProvisionOverlay mounts an overlay file system with the
+	// repository in the master GOPATH as its lower layer, so
+	// nothing is copied until it is modified. This needs root
+	// and is only available on Linux. Commands must run as
+	// the owner of the master GOPATH (so not with UidRange)
+	// to be able to modify the files. Changes to the master
+	// GOPATH while a build environment is open (by deploys)
+	// show through to it.
+	ProvisionOverlay = "overlay"
+)
+
+// CheckProvisionStrategy returns an error if
+// ProvisionStrategy is not a known strategy.
+func CheckProvisionStrategy() error {
+	switch ProvisionStrategy {
+	case "", ProvisionCopy, ProvisionClone, ProvisionHardlink, ProvisionReflink, ProvisionOverlay:
+		return nil
+	}
+	return fmt.Errorf("unknown provision strategy: %s", ProvisionStrategy)
+}
+
+// copyRepo copies the repository at srcRepoPath in the master
+// GOPATH to destRepoPath in the temporary GOPATH according to
+// the ProvisionStrategy, falling back to a deep copy if that
+// fails. The copy is owned by the uid of the build environment.
+// Files for which skip returns true are left out, if it is set
+// and the strategy copies files one by one. Symbolic links are
+// kept, except those that point outside of the repository.
+func (be BuildEnv) copyRepo(srcRepoPath, destRepoPath string, skip func(string, os.FileInfo) bool) error {
+	maxBytes, err := be.diskBudget()
+	if err != nil {
+		return err
+	}
+	defer be.gopathChanged()
+	var stats copyStats
+	cfg := deepCopyConfig{
+		Source:       srcRepoPath,
+		Dest:         destRepoPath,
+		KeepSymLinks: true,
+		ConfineLinks: true,
+		Owner:        be.uid,
+		MaxBytes:     maxBytes,
+		Workers:      runtime.NumCPU(),
+		Stats:        &stats,
+		Skip:         skip,
+	}
+	defer func() {
+		for _, link := range stats.Rejected {
+			be.log.Printf("not copying symbolic link that points outside of its repository: %s", link)
+		}
+	}()
+
+	switch ProvisionStrategy {
+	case ProvisionClone:
+		err = be.cloneRepo(srcRepoPath, destRepoPath)
+	case ProvisionHardlink:
+		if UidRange == "" {
+			err = fmt.Errorf("hard links are only safe when each build has its own uid")
+			break
+		}
+		cfg.Method = copyHardlink
+		err = deepCopy(cfg)
+	case ProvisionReflink:
+		cfg.Method = copyReflink
+		err = deepCopy(cfg)
+	case ProvisionOverlay:
+		err = be.overlayRepo(srcRepoPath, destRepoPath)
+	default:
+		return deepCopy(cfg)
+	}
+	if err == nil {
+		if ProvisionStrategy != ProvisionReflink {
+			// the copy still depends on the original
+			be.shareRepo(srcRepoPath)
+		}
+		return nil
+	}
+
+	be.log.Printf("WARNING: provisioning %s with strategy %s failed, falling back to copy: %v",
+		srcRepoPath, ProvisionStrategy, err)
+	err = os.RemoveAll(destRepoPath)
+	if err != nil {
+		return err
+	}
+	cfg.Method = copyContents
+	return deepCopy(cfg)
+}
+
+// cloneRepo makes a shared clone of the repository at
+// srcRepoPath at destRepoPath, whose origin is the same
+// as that of the original so that it can be fetched.
+func (be BuildEnv) cloneRepo(srcRepoPath, destRepoPath string) error {
+	// the master repository is owned by another user than the
+	// one commands run as, which git refuses to use unless told
+	// it is safe to; the local transport of `git clone` drops
+	// config given with -c, so it is given in a config file
+	// (cloning checks the .git folder itself)
+	safeConfig := filepath.Join(be.tmpGopath, "gitconfig_safe")
+	err := ioutil.WriteFile(safeConfig, []byte(fmt.Sprintf("[safe]\n\tdirectory = %s\n\tdirectory = %s\n",
+		strconv.Quote(srcRepoPath), strconv.Quote(filepath.Join(srcRepoPath, ".git")))), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(safeConfig)
+	safeEnv := "GIT_CONFIG_GLOBAL=" + safeConfig
+
+	var out bytes.Buffer
+	cmd := be.newCommand(classLocal, "git", "config", "--get", "remote.origin.url")
+	cmd.Env = append(cmd.Env, safeEnv)
+	cmd.Dir = srcRepoPath
+	cmd.Stdout = &out
+	err = be.runCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("getting origin URL: %v", err)
+	}
+	originURL := strings.TrimSpace(out.String())
+
+	err = be.mkdirAllOwned(filepath.Dir(destRepoPath))
+	if err != nil {
+		return err
+	}
+	cmd = be.newCommand(classLocal, "git", "clone", "--shared", "--quiet", srcRepoPath, destRepoPath)
+	cmd.Env = append(cmd.Env, safeEnv)
+	err = be.runCommand(cmd)
+	if err != nil {
+		return err
+	}
+	cmd = be.newCommand(classLocal, "git", "remote", "set-url", "origin", originURL)
+	cmd.Dir = destRepoPath
+	return be.runCommand(cmd)
+}
+
+// overlayRepo mounts an overlay file system at destRepoPath
+// with the repository at srcRepoPath as its lower layer. Its
+// upper layer is kept in the temporary GOPATH, outside of src.
+// The file system is unmounted when the build environment is
+// closed.
+func (be BuildEnv) overlayRepo(srcRepoPath, destRepoPath string) error {
+	if UidRange != "" {
+		return fmt.Errorf("overlays cannot be modified by commands running as another uid")
+	}
+	layers := filepath.Join(be.tmpGopath, "overlay", strconv.Itoa(len(*be.mounts)))
+	upper, work := filepath.Join(layers, "upper"), filepath.Join(layers, "work")
+	for _, dir := range []string{upper, work, destRepoPath} {
+		err := be.mkdirAllOwned(dir)
+		if err != nil {
+			return err
+		}
+	}
+	err := mountOverlay(srcRepoPath, upper, work, destRepoPath)
+	if err != nil {
+		return err
+	}
+	*be.mounts = append(*be.mounts, destRepoPath)
+	return nil
+}
+
+// unmountAll unmounts the file systems that were
+// mounted for the build environment, in reverse order.
+func (be BuildEnv) unmountAll() error {
+	if be.mounts == nil {
+		return nil
+	}
+	for i := len(*be.mounts) - 1; i >= 0; i-- {
+		err := unmount((*be.mounts)[i])
+		if err != nil {
+			return fmt.Errorf("unmounting %s: %v", (*be.mounts)[i], err)
+		}
+	}
+	*be.mounts = nil
+	return nil
+}
+
+// shareRepo marks the repository at repoPath in the master
+// GOPATH as in use by the build environment (see UseDir),
+// since the temporary GOPATH shares files with it, so that
+// PruneMasterGopath does not remove it until the build
+// environment is closed.
+func (be BuildEnv) shareRepo(repoPath string) {
+	if be.shared != nil {
+		*be.shared = append(*be.shared, UseDir(repoPath))
+	}
+}
+
+// releaseShared releases the repositories in the
+// master GOPATH that were marked by shareRepo.
+func (be BuildEnv) releaseShared() {
+	if be.shared == nil {
+		return
+	}
+	for _, release := range *be.shared {
+		release()
+	}
+	*be.shared = nil
+}
+
+// mkdirAllOwned is like os.MkdirAll, except that the
+// directories it creates are owned by the uid of the
+// build environment.
+func (be BuildEnv) mkdirAllOwned(dir string) error {
+	if dirExists(dir) {
+		return nil
+	}
+	err := be.mkdirAllOwned(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return chown(dir, be.uid)
+}
@@ -0,0 +1,28 @@
+package buildworker
+
+import (
+	"os"
+	"syscall"
+)
+
+// reflink makes dest share the blocks of src, which
+// must be on the same file system, using FICLONE.
+func reflink(dest, src *os.File) error {
+	const ficlone = 0x40049409
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dest.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// mountOverlay mounts an overlay file system at target.
+func mountOverlay(lower, upper, work, target string) error {
+	return syscall.Mount("overlay", target, "overlay", 0,
+		"lowerdir="+lower+",upperdir="+upper+",workdir="+work)
+}
+
+// unmount detaches the file system mounted at target.
+func unmount(target string) error {
+	return syscall.Unmount(target, syscall.MNT_DETACH)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+import (
+	"fmt"
+	"os"
+)
+
+// reflink returns an error, since reflinks
+// are only supported on Linux.
+func reflink(dest, src *os.File) error {
+	return fmt.Errorf("reflinks are only supported on Linux")
+}
+
+// mountOverlay returns an error, since overlay
+// file systems are only supported on Linux.
+func mountOverlay(lower, upper, work, target string) error {
+	return fmt.Errorf("overlay file systems are only supported on Linux")
+}
+
+// unmount returns an error, since nothing
+// is ever mounted on this platform.
+func unmount(target string) error {
+	return fmt.Errorf("unmounting is only supported on Linux")
+}
@@ -0,0 +1,289 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PruneMasterGopath removes the repositories from the master
+// GOPATH (from environment) that are no longer needed: those
+// which contain no package that Caddy, the plugins (import
+// paths of the currently registered plugins), or a repository
+// used by a build environment within the last keepUsedWithin
+// depends on, on any supported platform, including their
+// tests' dependencies. Repositories pinned by a lock file are
+// kept too (see LockFileRetention). It holds the write lock on
+// the master GOPATH while it works, so no builds can use it in
+// the meantime, and it keeps the repositories that open build
+// environments share files with (see ProvisionStrategy). It
+// returns the paths of the repositories that were removed
+// (relative to the src folder) and how many bytes were
+// reclaimed.
+func PruneMasterGopath(plugins []string, keepUsedWithin time.Duration) ([]string, int64, error) {
+	err := CheckMasterGopath()
+	if err != nil {
+		return nil, 0, err
+	}
+	be, err := newMasterEnv()
+	if err != nil {
+		return nil, 0, err
+	}
+	masterGopath := be.masterGopath
+
+	lock(masterGopath)
+	defer unlock(masterGopath)
+
+	repos, err := be.masterRepos()
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing repositories: %v", err)
+	}
+	if !repos[be.repoOf(CaddyPackage)] {
+		return nil, 0, fmt.Errorf("%s is not in the master GOPATH", CaddyPackage)
+	}
+
+	// start from caddy, the plugins, and whatever
+	// was used recently, and find everything they need
+	roots := append([]string{CaddyPackage}, plugins...)
+	err = updateRepoUsage(masterGopath, func(lastUsed map[string]time.Time) {
+		for repo, when := range lastUsed {
+			if time.Since(when) < keepUsedWithin && repos[repo] {
+				roots = append(roots, repo)
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	needed := make(map[string]bool)
+	for _, root := range roots {
+		if !dirExists(be.Path(root)) {
+			continue // plugin not fetched yet
+		}
+		pkgs, err := be.dependencies(root + "/...")
+		if err != nil {
+			return nil, 0, fmt.Errorf("finding dependencies of %s: %v: %s", root, err, be.Log.String())
+		}
+		for _, pkg := range pkgs {
+			needed[be.repoOf(pkg)] = true
+		}
+	}
+
+	// builds may ask for any lock file that is kept,
+	// so every repository they pin is needed as well
+	lfs, err := loadLockFiles(masterGopath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("loading lock files: %v", err)
+	}
+	for _, lf := range lfs {
+		for repo := range lf.Commits {
+			needed[repo] = true
+		}
+	}
+
+	var removed []string
+	var reclaimed int64
+	for repo := range repos {
+		path := be.Path(repo)
+		if needed[repo] || dirInUse(path) {
+			continue
+		}
+		size := dirSize(path)
+		err := os.RemoveAll(path)
+		if err != nil {
+			return removed, reclaimed, fmt.Errorf("removing %s: %v", repo, err)
+		}
+		removeEmptyParents(filepath.Dir(path), filepath.Join(masterGopath, "src"))
+		removed = append(removed, repo)
+		reclaimed += size
+	}
+
+	if len(removed) > 0 {
+		// compiled packages may belong to removed
+		// repositories; they can be remade
+		os.RemoveAll(filepath.Join(masterGopath, "pkg"))
+	}
+
+	err = updateRepoUsage(masterGopath, func(lastUsed map[string]time.Time) {
+		for _, repo := range removed {
+			delete(lastUsed, repo)
+		}
+	})
+	return removed, reclaimed, err
+}
+
+// masterRepos returns the set of repositories (the folders
+// with a .git folder in them, relative to the src folder)
+// in the master GOPATH.
+func (be BuildEnv) masterRepos() (map[string]bool, error) {
+	src := filepath.Join(be.masterGopath, "src")
+	repos := make(map[string]bool)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if dirExists(filepath.Join(path, ".git")) && path != src {
+			repos[filepath.ToSlash(strings.TrimPrefix(path, src+string(filepath.Separator)))] = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return repos, err
+}
+
+// repoOf returns the repository (relative to the src
+// folder of the master GOPATH) that pkg is in, or an
+// empty string if it is not in a repository.
+func (be BuildEnv) repoOf(pkg string) string {
+	repoPath := be.RepoPath(pkg)
+	src := filepath.Join(be.masterGopath, "src") + string(filepath.Separator)
+	if !strings.HasPrefix(repoPath, src) {
+		return ""
+	}
+	return filepath.ToSlash(strings.TrimPrefix(repoPath, src))
+}
+
+// dependencies returns the import paths of the packages
+// matching pattern in the master GOPATH, and of all the
+// packages they and their tests import, directly or not,
+// on this platform or any of the platforms we build for;
+// a repository imported only behind build constraints for
+// another platform is still needed.
+func (be BuildEnv) dependencies(pattern string) ([]string, error) {
+	const format = `{{if not .Standard}}{{.ImportPath}}{{range .Deps}} {{.}}{{end}}{{range .TestImports}} {{.}}{{end}}{{range .XTestImports}} {{.}}{{end}}{{end}}`
+
+	supported, err := SupportedPlatforms(UnsupportedPlatforms)
+	if err != nil {
+		return nil, fmt.Errorf("listing supported platforms: %v", err)
+	}
+	// the zero platform stands for this one, as is;
+	// GOARM does not change which files are built
+	platforms := []Platform{{}}
+	seenPlatform := make(map[string]bool)
+	for _, plat := range supported {
+		if !seenPlatform[plat.OS+"/"+plat.Arch] {
+			seenPlatform[plat.OS+"/"+plat.Arch] = true
+			platforms = append(platforms, Platform{OS: plat.OS, Arch: plat.Arch})
+		}
+	}
+
+	seen := make(map[string]bool)
+	var pkgs []string
+	patterns := []string{pattern}
+	for len(patterns) > 0 {
+		var out bytes.Buffer
+		for _, plat := range platforms {
+			args := append([]string{"list", "-e", "-f", format}, patterns...)
+			cmd := be.asMaster().newCommand(classLocal, "go", args...)
+			setEnvGopath(cmd.Env, be.masterGopath)
+			if plat.OS != "" {
+				// the same environment as goBuildChecks
+				cmd.Env = append(cmd.Env, "CGO_ENABLED=0", "GOOS="+plat.OS, "GOARCH="+plat.Arch)
+			}
+			cmd.Stdout = &out
+			err := be.runCommand(cmd)
+			if err != nil {
+				if plat.OS != "" {
+					return nil, fmt.Errorf("GOOS=%s GOARCH=%s: %v", plat.OS, plat.Arch, err)
+				}
+				return nil, err
+			}
+		}
+
+		// the packages imported by tests have dependencies
+		// of their own, which we have to ask for in turn
+		patterns = nil
+		for _, line := range strings.Split(out.String(), "\n") {
+			for i, pkg := range strings.Fields(line) {
+				if seen[pkg] {
+					continue
+				}
+				seen[pkg] = true
+				pkgs = append(pkgs, pkg)
+				if i > 0 && dirExists(be.Path(pkg)) {
+					patterns = append(patterns, pkg)
+				}
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// removeEmptyParents removes dir and its parents, up to
+// but not including stop, as long as they are empty.
+func removeEmptyParents(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if os.Remove(dir) != nil {
+			return // not empty
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// touchRepos records that the repositories at repoPaths
+// (as returned by RepoPath) in the master GOPATH were
+// just used, so that PruneMasterGopath keeps them for a
+// while. Errors are only logged, since keeping track of
+// usage is not essential to the build environment.
+func (be BuildEnv) touchRepos(repoPaths ...string) {
+	src := filepath.Join(be.masterGopath, "src") + string(filepath.Separator)
+	err := updateRepoUsage(be.masterGopath, func(lastUsed map[string]time.Time) {
+		for _, repoPath := range repoPaths {
+			if strings.HasPrefix(repoPath, src) {
+				lastUsed[filepath.ToSlash(strings.TrimPrefix(repoPath, src))] = time.Now()
+			}
+		}
+	})
+	if err != nil {
+		be.log.Printf("recording usage of repositories: %v", err)
+	}
+}
+
+// updateRepoUsage loads the last time each repository in
+// masterGopath was used from its usage file, calls update
+// with it, and saves it again.
+func updateRepoUsage(masterGopath string, update func(lastUsed map[string]time.Time)) error {
+	repoUsageMu.Lock()
+	defer repoUsageMu.Unlock()
+
+	file := filepath.Join(masterGopath, repoUsageFile)
+	lastUsed := make(map[string]time.Time)
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &lastUsed)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("loading repository usage: %v", err)
+	}
+
+	update(lastUsed)
+
+	data, err = json.MarshalIndent(lastUsed, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		return fmt.Errorf("saving repository usage: %v", err)
+	}
+	return nil
+}
+
+// repoUsageMu protects the usage files of master GOPATHs.
+var repoUsageMu sync.Mutex
+
+// repoUsageFile is the name of the file in the master
+// GOPATH that records when each repository was last used.
+const repoUsageFile = ".buildworker_usage.json"
@@ -0,0 +1,81 @@
+package buildworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveEmptyParents(t *testing.T) {
+	for i, test := range []struct {
+		dirs       []string // to make, relative to src
+		files      []string // to make, relative to src
+		remove     string   // the folder to remove, relative to src
+		expectGone []string
+		expectKept []string
+	}{
+		{
+			dirs:       []string{"example.com/user/repo"},
+			remove:     "example.com/user/repo",
+			expectGone: []string{"example.com/user/repo", "example.com/user", "example.com"},
+		},
+		{
+			dirs:       []string{"example.com/user/repo", "example.com/user/other"},
+			remove:     "example.com/user/repo",
+			expectGone: []string{"example.com/user/repo"},
+			expectKept: []string{"example.com/user/other", "example.com/user", "example.com"},
+		},
+		{
+			dirs:       []string{"example.com/user/repo"},
+			files:      []string{"example.com/README"},
+			remove:     "example.com/user/repo",
+			expectGone: []string{"example.com/user/repo", "example.com/user"},
+			expectKept: []string{"example.com"},
+		},
+		{
+			dirs:       []string{"example.com/user/repo/sub"},
+			remove:     "example.com/user/repo",
+			expectKept: []string{"example.com/user/repo/sub", "example.com/user/repo"},
+		},
+		{
+			remove: ".",
+		},
+	} {
+		gopath, err := ioutil.TempDir("", "buildworker_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := filepath.Join(gopath, "src")
+		err = os.Mkdir(src, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range test.dirs {
+			err := os.MkdirAll(filepath.Join(src, filepath.FromSlash(dir)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, file := range test.files {
+			err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(file)), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		removeEmptyParents(filepath.Join(src, filepath.FromSlash(test.remove)), src)
+
+		for _, dir := range test.expectGone {
+			if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(dir))); !os.IsNotExist(err) {
+				t.Errorf("Test %d: Expected %s to be removed, got: %v", i, dir, err)
+			}
+		}
+		for _, dir := range append(test.expectKept, ".") {
+			if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(dir))); err != nil {
+				t.Errorf("Test %d: Expected %s to be kept, got: %v", i, dir, err)
+			}
+		}
+		os.RemoveAll(gopath)
+	}
+}
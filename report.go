@@ -0,0 +1,58 @@
+package buildworker
+
+// Report holds the structured results of the checks
+// performed in a build environment. It is filled in
+// as the build environment is used, so that callers
+// can learn more about a failure than the log alone
+// would tell them.
+type Report struct {
+	// Problems found by static analysis of plugins.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+
+	// What each plugin registered with Caddy, by plugin
+	// package; each value is formatted "category/name".
+	Registered map[string][]string `json:"registered,omitempty"`
+
+	// Test coverage of each plugin, by plugin package.
+	Coverage map[string]Coverage `json:"coverage,omitempty"`
+
+	// Results of the tests that were run.
+	Tests []TestResult `json:"tests,omitempty"`
+
+	// Tests which failed at first but passed when they
+	// were retried, qualified by package.
+	FlakyTests []string `json:"flaky_tests,omitempty"`
+
+	// Resources used by the commands that were run,
+	// by phase (program and subcommand, like "go test").
+	Usage map[string]*ResourceUsage `json:"usage,omitempty"`
+
+	// Size of the temporary GOPATH after the last command.
+	TemporaryGopathBytes int64 `json:"temporary_gopath_bytes,omitempty"`
+
+	// ID of the lock file that a deploy wrote, or
+	// that a build pinned its dependencies to.
+	LockFile string `json:"lock_file,omitempty"`
+
+	// Repositories in the master GOPATH that updating it
+	// for a deploy changed (or, in a dry run, would change).
+	Changes []RepoChange `json:"changes,omitempty"`
+
+	// Origins that repositories in the master GOPATH had
+	// before a deploy pointed them to another URL (see
+	// PluginRepo), by repository (relative to the src
+	// folder). Reverting to a snapshot restores them.
+	PreviousOrigins map[string]string `json:"previous_origins,omitempty"`
+}
+
+// RepoChange is a change to a repository in the master GOPATH.
+type RepoChange struct {
+	Repo string `json:"repo"`          // relative to the src folder
+	Old  string `json:"old,omitempty"` // commit before; empty if the repository was added
+	New  string `json:"new,omitempty"` // commit after; empty if the repository was removed
+
+	// One-line summaries of the commits from Old to New,
+	// newest first, as from `git log --oneline`; if there
+	// are too many, the last entry is "...".
+	Log []string `json:"log,omitempty"`
+}
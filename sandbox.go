@@ -0,0 +1,71 @@
+package buildworker
+
+// commandClass describes what a command does, which
+// determines how strictly it can be isolated.
+type commandClass int
+
+const (
+	// classNetwork commands download code and
+	// need the network (go get, git fetch).
+	classNetwork commandClass = iota
+
+	// classLocal commands work with code that is
+	// already on disk without running it (go build,
+	// go vet, git checkout).
+	classLocal
+
+	// classUntrusted commands run arbitrary code
+	// (go test, plugin listings, smoke tests).
+	classUntrusted
+)
+
+// Sandbox is the backend used to isolate commands. The
+// default (empty string) isolates commands only with
+// Chroot and UidGid. With SandboxNamespaces, commands
+// run in their own Linux namespaces instead, which is
+// stricter: they see only the toolchain, the system
+// directories (read-only), the master GOPATH, and their
+// own temporary GOPATH, and only commands that download
+// code may use the network. Chroot is ignored when the
+// namespaces sandbox is used.
+var Sandbox string
+
+// SandboxNamespaces is the value of Sandbox that enables
+// the Linux namespaces sandbox backend.
+const SandboxNamespaces = "namespaces"
+
+// sandboxSpec describes the sandbox a command runs in.
+// It is passed from the build worker to the sandbox helper
+// process, which sets up the sandbox before running the
+// command. The helper is used for the namespaces sandbox
+// and for Hardening.
+type sandboxSpec struct {
+	// These fields are used with the namespaces sandbox.
+	Namespaces bool     // whether to set up the namespaces sandbox
+	Root       string   // mount point for the root of the sandbox
+	Network    bool     // whether the command may use the network
+	ReadOnly   []string // paths to bind into the sandbox read-only
+	Writable   []string // paths to bind into the sandbox read-write
+	Tmpfs      []string // paths at which to mount empty file systems
+
+	// These fields are used without the namespaces sandbox,
+	// in which case the helper jails itself and switches
+	// to the uid (and gid) if they are set.
+	Chroot string
+	Uid    int
+
+	// These fields are used for Hardening.
+	Harden         bool   // whether to apply hardening
+	Strict         bool   // whether hardening must be fully applied
+	SeccompProfile string // path to seccomp profile; empty for built-in
+}
+
+const (
+	// sandboxArg0 is the value of argv[0] with which the
+	// build worker is re-executed as the sandbox helper.
+	sandboxArg0 = "buildworker-sandbox"
+
+	// sandboxEnvVar is the environment variable through
+	// which the sandboxSpec is passed to the helper.
+	sandboxEnvVar = "BUILDWORKER_SANDBOX"
+)
@@ -0,0 +1,498 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// When the build worker is re-executed as the sandbox helper,
+// it sets up the sandbox and replaces itself with the command
+// to run before anything else in the program gets a chance to
+// run (like the main package's init functions, which may have
+// side effects such as printing warnings).
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == sandboxArg0 {
+		// namespace and credential changes apply
+		// to the calling thread, which must be the
+		// one that execs the command
+		runtime.LockOSThread()
+		err := sandboxInit()
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// sandboxCommand changes cmd so that it runs through the sandbox
+// helper: the build worker is re-executed as the helper, which
+// sets up the sandbox and hardening (as configured) and then
+// executes the original command.
+//
+// With the namespaces sandbox, the helper runs in new namespaces
+// and sets up the file system. Commands of classNetwork share
+// the network of the build worker and may write to the master
+// GOPATH; all other commands get a network namespace with only
+// a loopback interface and see the master GOPATH read-only. No
+// command has any capabilities in the sandbox.
+// Without it, the helper applies Chroot and the uid itself, so
+// that hardening can be done before privileges are dropped.
+func (be BuildEnv) sandboxCommand(cmd *exec.Cmd, class commandClass) {
+	spec := sandboxSpec{
+		Uid:            -1,
+		Harden:         Hardening != "",
+		Strict:         Hardening == HardeningStrict,
+		SeccompProfile: SeccompProfile,
+	}
+	if Sandbox != SandboxNamespaces {
+		spec.Chroot = Chroot
+		spec.Uid = be.uid
+		if Chroot != "" {
+			cmd.Dir = "/" // see newCommand()
+		}
+		be.wrapCommand(cmd, spec)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		return
+	}
+
+	spec.Namespaces = true
+	spec.Root = filepath.Join(os.TempDir(), "buildworker_sandbox")
+	spec.Network = class == classNetwork
+	spec.ReadOnly = sandboxSystemPaths()
+	spec.Writable = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+	// hide everything else in the temporary directory,
+	// including the temporary GOPATHs of other builds
+	spec.Tmpfs = []string{os.TempDir()}
+
+	if be.tmpGopath != "" {
+		spec.Writable = append(spec.Writable, be.tmpGopath)
+	}
+	if be.masterGopath != "" {
+		if class == classNetwork {
+			spec.Writable = append(spec.Writable, be.masterGopath)
+		} else {
+			spec.ReadOnly = append(spec.ReadOnly, be.masterGopath)
+		}
+	}
+	if class == classNetwork {
+		spec.ReadOnly = append(spec.ReadOnly, loadedCredentials.paths...)
+	}
+	if filepath.IsAbs(cmd.Path) && strings.HasPrefix(cmd.Path, os.TempDir()) {
+		// the command itself (e.g. a fresh build of caddy)
+		// is in the temporary directory, so let it be seen
+		spec.ReadOnly = append(spec.ReadOnly, filepath.Dir(cmd.Path))
+	}
+	be.wrapCommand(cmd, spec)
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	if be.uid > -1 {
+		uid, gid = be.uid, be.uid
+	}
+	cloneflags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if !spec.Network {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	// the command is not root in the sandbox, so it has no
+	// capabilities there; the helper keeps only the ones it
+	// needs to set up the sandbox, and drops them before it
+	// executes the command
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  cloneflags,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: sandboxUid, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: sandboxUid, HostID: gid, Size: 1}},
+		AmbientCaps: []uintptr{capSysAdmin, capNetAdmin, capSetpcap},
+		Setsid:      true,
+	}
+}
+
+// sandboxUid is the uid (and gid) that commands run as in
+// the namespaces sandbox. It is mapped to the uid of the
+// build environment on the host; it must not be 0, or
+// commands would get all capabilities in the sandbox (and
+// could, for example, make read-only mounts writable).
+const sandboxUid = 1000
+
+// Capabilities that the sandbox helper needs to set up the
+// namespaces sandbox: mounting file systems and setting the
+// host name (CAP_SYS_ADMIN), bringing up the loopback
+// interface (CAP_NET_ADMIN), and dropping capabilities from
+// the bounding set (CAP_SETPCAP).
+const (
+	capSetpcap  = 8
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// dropCapabilities drops all capabilities of the current
+// process (which must be the sandbox helper, running on a
+// locked thread), including its ambient capabilities and
+// the bounding set, so that the command it executes has no
+// capabilities no matter which uid it runs as.
+func dropCapabilities() error {
+	for c := 0; ; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBsetDrop, uintptr(c), 0)
+		if errno == syscall.EINVAL {
+			break // no more capabilities
+		}
+		if errno != 0 {
+			return fmt.Errorf("dropping bounding set: %v", errno)
+		}
+	}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("clearing ambient capabilities: %v", errno)
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("clearing capabilities: %v", errno)
+	}
+	return nil
+}
+
+// wrapCommand changes cmd to run the sandbox helper
+// with spec, which in turn runs the original command.
+func (be BuildEnv) wrapCommand(cmd *exec.Cmd, spec sandboxSpec) {
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		panic(err) // can't happen: sandboxSpec is always encodable
+	}
+	cmd.Args = append([]string{sandboxArg0, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Env = append(cmd.Env, sandboxEnvVar+"="+string(specJSON))
+}
+
+// CheckSandbox returns an error if Sandbox is
+// set but commands cannot be run in it.
+func CheckSandbox() error {
+	switch Sandbox {
+	case "":
+		return nil
+	case SandboxNamespaces:
+	default:
+		return fmt.Errorf("unknown sandbox: %s", Sandbox)
+	}
+	out := new(bytes.Buffer)
+	be := BuildEnv{
+		masterGopath: os.Getenv("GOPATH"),
+		uid:          UidGid,
+		Log:          out,
+		log:          log.New(out, "", 0),
+		Report:       new(Report),
+	}
+	err := be.runCommand(be.newCommand(classUntrusted, "go", "version"))
+	if err != nil {
+		return fmt.Errorf("running command in sandbox: %v: %s", err, out.String())
+	}
+	return nil
+}
+
+// sandboxSystemPaths returns the paths that commands need
+// to see in order to run: system directories, the Go
+// toolchain, and everything in PATH.
+func sandboxSystemPaths() []string {
+	candidates := []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc", goRoot()}
+	candidates = append(candidates, filepath.SplitList(os.Getenv("PATH"))...)
+
+	var paths []string
+	for _, path := range candidates {
+		if !filepath.IsAbs(path) {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		covered := false
+		for _, p := range paths {
+			if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			paths = append(paths, filepath.Clean(path))
+		}
+	}
+	return paths
+}
+
+// sandboxExposes returns true if path is in one of the
+// sandboxSystemPaths, which all commands can read.
+func sandboxExposes(path string) bool {
+	for _, p := range sandboxSystemPaths() {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxInit is run by the sandbox helper process, which
+// was started in new namespaces if the namespaces sandbox
+// is used. It sets up the sandbox and hardening described
+// by the spec in its environment, then executes the command
+// in its arguments. It only returns on error.
+func sandboxInit() error {
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(os.Getenv(sandboxEnvVar)), &spec)
+	if err != nil {
+		return fmt.Errorf("decoding sandbox spec: %v", err)
+	}
+
+	// the command should not see the spec
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, sandboxEnvVar+"=") {
+			env = append(env, v)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = "/"
+	}
+
+	// the seccomp profile may not be
+	// visible once we are jailed
+	var filter []sockFilter
+	var filterErr error
+	if spec.Harden {
+		filter, filterErr = seccompFilter(spec.SeccompProfile)
+	}
+
+	if spec.Namespaces {
+		err = spec.setUp()
+		if err != nil {
+			return err
+		}
+	} else if spec.Chroot != "" {
+		err = syscall.Chroot(spec.Chroot)
+		if err != nil {
+			return fmt.Errorf("chroot: %v", err)
+		}
+	}
+
+	if err := os.Chdir(cwd); err != nil {
+		os.Chdir("/")
+	}
+
+	if spec.Namespaces {
+		err = dropCapabilities()
+		if err != nil {
+			return err
+		}
+	}
+
+	if spec.Harden {
+		err = spec.harden(filter, filterErr)
+		if err != nil {
+			return err
+		}
+	} else if spec.Uid > -1 {
+		err = syscall.Setgroups(nil)
+		if err == nil {
+			err = syscall.Setgid(spec.Uid)
+		}
+		if err == nil {
+			err = syscall.Setuid(spec.Uid)
+		}
+		if err != nil {
+			return fmt.Errorf("switching to uid %d: %v", spec.Uid, err)
+		}
+	}
+
+	return syscall.Exec(os.Args[1], os.Args[1:], env)
+}
+
+// setUp builds the file system of the sandbox at spec.Root
+// and makes it the root of the file system. It must be
+// run in new user and mount namespaces (and, for /proc,
+// a new PID namespace).
+func (spec sandboxSpec) setUp() error {
+	// keep our mounts from propagating to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	err = os.MkdirAll(spec.Root, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", spec.Root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting sandbox root: %v", err)
+	}
+
+	// mount parents before their children (for example,
+	// a tmpfs on /tmp before the temporary GOPATH in it)
+	type mount struct {
+		path     string
+		tmpfs    bool
+		readOnly bool
+	}
+	var mounts []mount
+	for _, path := range spec.Tmpfs {
+		mounts = append(mounts, mount{path: path, tmpfs: true})
+	}
+	for _, path := range spec.ReadOnly {
+		mounts = append(mounts, mount{path: path, readOnly: true})
+	}
+	for _, path := range spec.Writable {
+		mounts = append(mounts, mount{path: path})
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(filepath.Clean(mounts[i].path), "/") <
+			strings.Count(filepath.Clean(mounts[j].path), "/")
+	})
+
+	for _, m := range mounts {
+		target := filepath.Join(spec.Root, m.path)
+		if m.tmpfs {
+			err := os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+			if err != nil {
+				return fmt.Errorf("mounting tmpfs at %s: %v", m.path, err)
+			}
+			continue
+		}
+		err := bindMount(m.path, target, m.readOnly)
+		if err != nil {
+			return fmt.Errorf("bind mounting %s: %v", m.path, err)
+		}
+	}
+
+	proc := filepath.Join(spec.Root, "proc")
+	err = os.MkdirAll(proc, 0555)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+
+	if !spec.Network {
+		err = loopbackUp()
+		if err != nil {
+			return fmt.Errorf("bringing up loopback interface: %v", err)
+		}
+	}
+
+	err = syscall.Sethostname([]byte("buildworker"))
+	if err != nil {
+		return fmt.Errorf("setting hostname: %v", err)
+	}
+
+	// switch to the new root and get rid of the old one
+	oldRoot := filepath.Join(spec.Root, ".old_root")
+	err = os.Mkdir(oldRoot, 0700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(spec.Root, oldRoot)
+	if err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	err = os.Chdir("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount("/.old_root", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("unmounting old root: %v", err)
+	}
+	return os.Remove("/.old_root")
+}
+
+// bindMount bind mounts source at target, creating target
+// if necessary. Paths that do not exist are skipped.
+func bindMount(source, target string, readOnly bool) error {
+	info, err := os.Stat(source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+
+	// a bind mount can only be made read-only by remounting
+	// it, and in a user namespace, flags which are already
+	// set on the mount must be kept
+	var st syscall.Statfs_t
+	err = syscall.Statfs(target, &st)
+	if err != nil {
+		return err
+	}
+	locked := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|locked, "")
+}
+
+// loopbackUp brings up the loopback interface, which
+// is down in a new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// sandboxCommand does nothing, since neither the
+// namespaces sandbox nor hardening is available.
+func (be BuildEnv) sandboxCommand(cmd *exec.Cmd, class commandClass) {}
+
+// sandboxExposes returns false, since there
+// is no sandbox that could expose path.
+func sandboxExposes(path string) bool { return false }
+
+// CheckSandbox returns an error if Sandbox is set, since
+// no sandbox backend is available on this platform.
+func CheckSandbox() error {
+	if Sandbox != "" {
+		return fmt.Errorf("sandbox %s is only available on Linux", Sandbox)
+	}
+	return nil
+}
+
+// CheckHardening returns an error if Hardening is set,
+// since hardening is only available on Linux.
+func CheckHardening() error {
+	if Hardening != "" {
+		return fmt.Errorf("hardening is only available on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build linux && !amd64
+// +build linux,!amd64
+
+package buildworker
+
+// seccompArch is zero because seccomp filters
+// are not supported on this architecture.
+const seccompArch = 0
+
+// seccompSyscalls is empty because seccomp filters
+// are not supported on this architecture.
+var seccompSyscalls map[string]uint32
@@ -0,0 +1,609 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotRetention is how many snapshots of the
+// master GOPATH to keep (0 for all); older ones are
+// deleted when a new one is taken.
+var SnapshotRetention = 10
+
+// VerifyRestore enables comparing the contents of files
+// when restoring a snapshot, rather than trusting that
+// files with the same size and modification time as in
+// the snapshot are unchanged; see repoMatches.
+var VerifyRestore bool
+
+// Snapshot is a record of the state of the master GOPATH:
+// the commit that every repository in it has checked out,
+// along with copies of any files that differ from it.
+type Snapshot struct {
+	ID      string                  `json:"id"`
+	Created time.Time               `json:"created"`
+	Deploy  string                  `json:"deploy,omitempty"` // what was being deployed when it was taken
+	Repos   map[string]SnapshotRepo `json:"repos"`            // keyed by path relative to the src folder
+}
+
+// SnapshotRepo is the state of a repository in a Snapshot.
+// Paths of files are relative to the repository.
+type SnapshotRepo struct {
+	Origin  string            `json:"origin,omitempty"`
+	Branch  string            `json:"branch,omitempty"` // empty if HEAD was detached
+	Commit  string            `json:"commit"`
+	Changed []string          `json:"changed,omitempty"` // modified or untracked files, copied into the snapshot
+	Links   map[string]string `json:"links,omitempty"`   // modified or untracked symbolic links, and their targets
+	Deleted []string          `json:"deleted,omitempty"` // tracked files that did not exist
+}
+
+// commits returns the commit of each repository in
+// the snapshot, by its path relative to the src folder.
+func (snap Snapshot) commits() map[string]string {
+	commits := make(map[string]string)
+	for repo, sr := range snap.Repos {
+		commits[repo] = sr.Commit
+	}
+	return commits
+}
+
+// TakeSnapshot takes a snapshot of the master GOPATH
+// (from environment). deploy describes why, if anything.
+func TakeSnapshot(deploy string) (Snapshot, error) {
+	err := CheckMasterGopath()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	be, err := newMasterEnv()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return be.takeSnapshot(deploy)
+}
+
+// Snapshots returns the snapshots of the master
+// GOPATH (from environment), newest first.
+func Snapshots() ([]Snapshot, error) {
+	masterGopath := os.Getenv("GOPATH")
+	if masterGopath == "" {
+		return nil, fmt.Errorf("no master GOPATH")
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	return loadSnapshots(masterGopath)
+}
+
+// RestoreSnapshot restores the master GOPATH (from
+// environment) to the snapshot with the given ID.
+// The log of the commands it ran is returned along
+// with any error.
+func RestoreSnapshot(id string) (string, error) {
+	be, err := newMasterEnv()
+	if err != nil {
+		return "", err
+	}
+	err = be.restoreSnapshot(id)
+	return be.Log.String(), err
+}
+
+// takeSnapshot records the state of every repository in the
+// master GOPATH of the build environment as a new snapshot,
+// and deletes the oldest snapshots beyond SnapshotRetention.
+// Files that differ from the checked-out commits are copied
+// into the snapshot, since checking out cannot restore them.
+func (be BuildEnv) takeSnapshot(deploy string) (Snapshot, error) {
+	be.tmpGopath = "" // only the master GOPATH is involved
+
+	rlock(be.masterGopath)
+	defer runlock(be.masterGopath)
+
+	now := time.Now().UTC()
+	snap := Snapshot{
+		ID:      timestampID(now),
+		Created: now,
+		Deploy:  deploy,
+		Repos:   make(map[string]SnapshotRepo),
+	}
+
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+
+	// assemble the snapshot under a temporary name, so
+	// that an incomplete one is never mistaken for one
+	dir := filepath.Join(be.masterGopath, snapshotsFolder, snap.ID)
+	tmpDir := dir + ".tmp"
+	err := os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return snap, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	repos, err := be.masterRepos()
+	if err != nil {
+		return snap, fmt.Errorf("listing repositories: %v", err)
+	}
+	for repo := range repos {
+		sr, err := be.snapshotRepo(repo, filepath.Join(tmpDir, "files", filepath.FromSlash(repo)))
+		if err != nil {
+			return snap, fmt.Errorf("taking snapshot of %s: %v", repo, err)
+		}
+		snap.Repos[repo] = sr
+	}
+
+	manifest, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return snap, err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpDir, snapshotManifest), manifest, 0644)
+	if err != nil {
+		return snap, err
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		return snap, err
+	}
+	be.log.Printf("took snapshot %s of %d repositories in master GOPATH", snap.ID, len(snap.Repos))
+
+	// only keep the newest snapshots, and none
+	// that were left incomplete by a crash
+	leftovers, _ := filepath.Glob(filepath.Join(be.masterGopath, snapshotsFolder, "*.tmp"))
+	for _, leftover := range leftovers {
+		os.RemoveAll(leftover)
+	}
+	snaps, err := loadSnapshots(be.masterGopath)
+	if err != nil {
+		return snap, err
+	}
+	for i := SnapshotRetention; SnapshotRetention > 0 && i < len(snaps); i++ {
+		err := os.RemoveAll(filepath.Join(be.masterGopath, snapshotsFolder, snaps[i].ID))
+		if err != nil {
+			return snap, fmt.Errorf("deleting old snapshot: %v", err)
+		}
+	}
+
+	return snap, nil
+}
+
+// snapshotRepo records the state of the repository at repo
+// (relative to the src folder of the master GOPATH), copying
+// files that differ from its commit into filesDir. The copies
+// keep their modification times, so that restoring can tell
+// whether they changed (see repoMatches).
+func (be BuildEnv) snapshotRepo(repo, filesDir string) (SnapshotRepo, error) {
+	sr, err := be.repoState(repo)
+	if err != nil {
+		return sr, err
+	}
+	repoPath := be.Path(repo)
+	for _, file := range sr.Changed {
+		path := filepath.Join(repoPath, filepath.FromSlash(file))
+		dest := filepath.Join(filesDir, filepath.FromSlash(file))
+		err := copyPlainFile(path, dest)
+		if err != nil {
+			return sr, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return sr, err
+		}
+		err = os.Chtimes(dest, info.ModTime(), info.ModTime())
+		if err != nil {
+			return sr, err
+		}
+	}
+	return sr, nil
+}
+
+// repoState returns the state of the repository at repo
+// (relative to the src folder of the master GOPATH), without
+// copying anything: the files that differ from its commit
+// are only listed.
+func (be BuildEnv) repoState(repo string) (SnapshotRepo, error) {
+	repoPath := be.Path(repo)
+	var sr SnapshotRepo
+	var err error
+	sr.Commit, err = be.gitOutput(repoPath, "rev-parse", "HEAD")
+	if err != nil {
+		return sr, err
+	}
+	sr.Branch, err = be.gitOutput(repoPath, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return sr, err
+	}
+	if sr.Branch == "HEAD" {
+		sr.Branch = "" // detached
+	}
+	sr.Origin, _ = be.gitOutput(repoPath, "config", "--get", "remote.origin.url") // may not have one
+
+	// files that differ from the commit: modified, deleted,
+	// and untracked ones (except those that are ignored)
+	modified, err := be.gitOutput(repoPath, "diff", "--name-only", "-z", "HEAD")
+	if err != nil {
+		return sr, err
+	}
+	untracked, err := be.gitOutput(repoPath, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return sr, err
+	}
+	for _, file := range strings.Split(modified+"\x00"+untracked, "\x00") {
+		if file == "" {
+			continue
+		}
+		path := filepath.Join(repoPath, filepath.FromSlash(file))
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			sr.Deleted = append(sr.Deleted, file)
+			continue
+		}
+		if err != nil {
+			return sr, err
+		}
+		if info.Mode()&os.ModeSymlink > 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return sr, err
+			}
+			if sr.Links == nil {
+				sr.Links = make(map[string]string)
+			}
+			sr.Links[file] = target
+			continue
+		}
+		sr.Changed = append(sr.Changed, file)
+	}
+
+	return sr, nil
+}
+
+// repoMatches returns true if the repository at repo
+// (relative to the src folder of the master GOPATH) is
+// still in the state in sr: at the same commit and branch,
+// with the same files differing from it, and the changed
+// files the same as their copies in filesDir (compared
+// like an incremental deepCopy does, and by contents if
+// VerifyRestore is set).
+func (be BuildEnv) repoMatches(repo string, sr SnapshotRepo, filesDir string) (bool, error) {
+	current, err := be.repoState(repo)
+	if err != nil {
+		return false, err
+	}
+	if current.Commit != sr.Commit || current.Branch != sr.Branch ||
+		!sameFileList(current.Changed, sr.Changed) ||
+		!sameFileList(current.Deleted, sr.Deleted) ||
+		len(current.Links) != len(sr.Links) {
+		return false, nil
+	}
+	for file, target := range sr.Links {
+		if current.Links[file] != target {
+			return false, nil
+		}
+	}
+	cfg := deepCopyConfig{Incremental: true, CompareHash: VerifyRestore}
+	repoPath := be.Path(repo)
+	for _, file := range sr.Changed {
+		srcPath := filepath.Join(filesDir, filepath.FromSlash(file))
+		destPath := filepath.Join(repoPath, filepath.FromSlash(file))
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil {
+			return false, err
+		}
+		destInfo, err := os.Lstat(destPath)
+		if err != nil {
+			return false, nil
+		}
+		same, err := sameContents(cfg, srcPath, srcInfo, destPath, destInfo)
+		if err != nil || !same {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// sameFileList returns true if a and b list
+// the same files, in any order.
+func sameFileList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreSnapshot restores the master GOPATH of the build
+// environment to the snapshot with the given ID: every
+// repository in the snapshot is checked out at its commit
+// (fetching or cloning it from its origin if necessary),
+// and the files that differed from the commit are put back.
+// Repositories that are not in the snapshot are left alone.
+// The progress is kept in a journal (see restoreJournal).
+func (be BuildEnv) restoreSnapshot(id string) error {
+	be.tmpGopath = "" // only the master GOPATH is involved
+
+	lock(be.masterGopath)
+	defer unlock(be.masterGopath)
+
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+
+	snap, err := loadSnapshot(be.masterGopath, id)
+	if err != nil {
+		return err
+	}
+	filesDir := filepath.Join(be.masterGopath, snapshotsFolder, snap.ID, "files")
+
+	// keep a journal of the progress, so that the restore can
+	// be resumed if it is interrupted, and so that nothing uses
+	// the master GOPATH until then; resume the previous restore
+	// if it was to the same snapshot
+	journal, err := loadRestoreJournal(be.masterGopath)
+	if err != nil {
+		return err
+	}
+	if journal == nil || journal.Snapshot != snap.ID {
+		journal = &restoreJournal{Snapshot: snap.ID, Started: time.Now().UTC()}
+	}
+	done := make(map[string]bool)
+	for _, repo := range journal.Restored {
+		done[repo] = true
+	}
+	err = journal.save(be.masterGopath)
+	if err != nil {
+		return err
+	}
+
+	repos := make([]string, 0, len(snap.Repos))
+	for repo := range snap.Repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		if done[repo] {
+			continue
+		}
+		err := be.restoreRepo(repo, snap.Repos[repo], filepath.Join(filesDir, filepath.FromSlash(repo)))
+		if err != nil {
+			return fmt.Errorf("restoring %s from snapshot %s: %v", repo, snap.ID, err)
+		}
+		journal.Restored = append(journal.Restored, repo)
+		err = journal.save(be.masterGopath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// also delete pkg and bin directories that were there;
+	// they can be remade and may be stale
+	os.RemoveAll(filepath.Join(be.masterGopath, "pkg"))
+	os.RemoveAll(filepath.Join(be.masterGopath, "bin"))
+
+	err = os.Remove(filepath.Join(be.masterGopath, restoreJournalFile))
+	if err != nil {
+		return fmt.Errorf("removing restore journal: %v", err)
+	}
+	be.log.Printf("restored master GOPATH to snapshot %s", snap.ID)
+	return nil
+}
+
+// restoreRepo restores the repository at repo (relative to
+// the src folder of the master GOPATH) to the state in sr,
+// with the changed files from filesDir.
+func (be BuildEnv) restoreRepo(repo string, sr SnapshotRepo, filesDir string) error {
+	repoPath := be.Path(repo)
+	master := be.asMaster()
+
+	// commands that write to the master GOPATH are of
+	// classNetwork, which is the only class allowed to
+	// write to it in the sandbox
+	existed := dirExists(repoPath)
+	if !existed {
+		if sr.Origin == "" {
+			return fmt.Errorf("repository is gone and has no origin to clone it from")
+		}
+		err := master.mkdirAllOwned(filepath.Dir(repoPath))
+		if err != nil {
+			return err
+		}
+		cmd := master.newCommand(classNetwork, "git", "clone", "--quiet", "--no-checkout", sr.Origin, repoPath)
+		err = master.runCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("cloning: %v", err)
+		}
+	}
+	// a deploy from another URL may have changed the origin
+	if sr.Origin != "" {
+		origin, err := be.gitOutput(repoPath, "config", "--get", "remote.origin.url")
+		if err != nil || origin != sr.Origin {
+			err := master.setOrigin(repoPath, sr.Origin)
+			if err != nil {
+				return fmt.Errorf("restoring origin %s: %v", sr.Origin, err)
+			}
+		}
+	}
+	// most repositories are usually untouched since the
+	// snapshot; those are left as they are
+	if existed {
+		same, err := be.repoMatches(repo, sr, filesDir)
+		if err != nil {
+			return fmt.Errorf("comparing with snapshot: %v", err)
+		}
+		if same {
+			return nil
+		}
+	}
+
+	if _, err := be.gitOutput(repoPath, "cat-file", "-e", sr.Commit+"^{commit}"); err != nil {
+		cmd := master.newCommand(classNetwork, "git", "fetch", "--quiet", "origin")
+		cmd.Dir = repoPath
+		err = master.runCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("fetching missing commit %s: %v", sr.Commit, err)
+		}
+	}
+
+	// check out the commit (on the branch, if there was one,
+	// so `go get -u` can still pull) and remove untracked files
+	args := []string{"checkout", "--quiet", "--force", "--detach", sr.Commit}
+	if sr.Branch != "" {
+		args = []string{"checkout", "--quiet", "--force", "-B", sr.Branch, sr.Commit}
+	}
+	for _, args := range [][]string{args, {"clean", "--quiet", "--force", "-d"}} {
+		cmd := master.newCommand(classNetwork, "git", args...)
+		cmd.Dir = repoPath
+		err := master.runCommand(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// put back what differed from the commit
+	for _, file := range sr.Changed {
+		dest := filepath.Join(repoPath, filepath.FromSlash(file))
+		err := master.mkdirAllOwned(filepath.Dir(dest))
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		src := filepath.Join(filesDir, filepath.FromSlash(file))
+		err = copyPlainFile(src, dest)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(dest, info.ModTime(), info.ModTime()) // see repoMatches
+		if err != nil {
+			return err
+		}
+		err = chown(dest, UidGid)
+		if err != nil {
+			return err
+		}
+	}
+	for file, target := range sr.Links {
+		dest := filepath.Join(repoPath, filepath.FromSlash(file))
+		err := master.mkdirAllOwned(filepath.Dir(dest))
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		err = os.Symlink(target, dest)
+		if err != nil {
+			return err
+		}
+		if UidGid > -1 {
+			err = os.Lchown(dest, UidGid, UidGid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, file := range sr.Deleted {
+		err := os.Remove(filepath.Join(repoPath, filepath.FromSlash(file)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gitOutput runs git with args in the repository at repoPath
+// in the master GOPATH and returns its trimmed output.
+func (be BuildEnv) gitOutput(repoPath string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := be.asMaster().newCommand(classLocal, "git", args...)
+	cmd.Dir = repoPath
+	cmd.Stdout = &out
+	err := be.runCommand(cmd)
+	return strings.TrimSpace(out.String()), err
+}
+
+// loadSnapshots loads the manifests of all the snapshots
+// of masterGopath, newest first. snapshotsMu must be held.
+func loadSnapshots(masterGopath string) ([]Snapshot, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(masterGopath, snapshotsFolder))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		snap, err := loadSnapshot(masterGopath, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.After(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+// loadSnapshot loads the manifest of the snapshot of
+// masterGopath with the given ID. snapshotsMu must be held.
+func loadSnapshot(masterGopath, id string) (Snapshot, error) {
+	var snap Snapshot
+	if !validID(id) {
+		return snap, fmt.Errorf("invalid snapshot ID: %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(masterGopath, snapshotsFolder, id, snapshotManifest))
+	if os.IsNotExist(err) {
+		return snap, fmt.Errorf("no snapshot %s", id)
+	}
+	if err != nil {
+		return snap, err
+	}
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return snap, fmt.Errorf("loading snapshot %s: %v", id, err)
+	}
+	return snap, nil
+}
+
+// timestampID returns an ID for something (like a
+// snapshot) made at t, which sorts chronologically.
+func timestampID(t time.Time) string {
+	return t.UTC().Format("20060102-150405.000000")
+}
+
+// validID returns true if id (as from timestampID, but
+// given by a client) is safe to use as a file name.
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.HasPrefix(id, ".")
+}
+
+// snapshotsMu protects the snapshot folders of master GOPATHs.
+var snapshotsMu sync.Mutex
+
+const (
+	// snapshotsFolder is the name of the folder in the master
+	// GOPATH (outside of src) that snapshots are kept in.
+	snapshotsFolder = ".buildworker_snapshots"
+
+	// snapshotManifest is the name of the file in the folder
+	// of a snapshot that describes it.
+	snapshotManifest = "manifest.json"
+)
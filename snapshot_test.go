@@ -0,0 +1,55 @@
+package buildworker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotCommits(t *testing.T) {
+	for i, test := range []struct {
+		repos  map[string]SnapshotRepo
+		expect map[string]string
+	}{
+		{
+			repos:  nil,
+			expect: map[string]string{},
+		},
+		{
+			repos: map[string]SnapshotRepo{
+				"github.com/mholt/caddy": {Origin: "https://github.com/mholt/caddy", Branch: "master", Commit: "abc"},
+				"example.com/plugin":     {Commit: "def", Changed: []string{"plugin.go"}, Deleted: []string{"old.go"}},
+			},
+			expect: map[string]string{
+				"github.com/mholt/caddy": "abc",
+				"example.com/plugin":     "def",
+			},
+		},
+	} {
+		actual := Snapshot{Repos: test.repos}.commits()
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expect, actual)
+		}
+	}
+}
+
+func TestSameFileList(t *testing.T) {
+	for i, test := range []struct {
+		a, b   []string
+		expect bool
+	}{
+		{a: nil, b: nil, expect: true},
+		{a: nil, b: []string{}, expect: true},
+		{a: []string{"b", "a"}, b: []string{"a", "b"}, expect: true},
+		{a: []string{"a", "b"}, b: []string{"a"}, expect: false},
+		{a: []string{"a", "a"}, b: []string{"a", "b"}, expect: false},
+		{a: []string{"a/b"}, b: []string{"a/c"}, expect: false},
+	} {
+		a := append([]string(nil), test.a...)
+		if actual := sameFileList(test.a, test.b); actual != test.expect {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expect, actual)
+		}
+		if !reflect.DeepEqual(a, test.a) {
+			t.Errorf("Test %d: Expected the list to be left as it was, got %v", i, test.a)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package buildworker
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncFileSystem flushes the file system that path is on
+// to disk, without waiting for any other file systems.
+func syncFileSystem(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := syscall.Syscall(sysSyncfs, f.Fd(), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
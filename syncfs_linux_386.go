@@ -0,0 +1,5 @@
+package buildworker
+
+// sysSyncfs is the number of the syncfs system
+// call, which the syscall package lacks on 386.
+const sysSyncfs = 344
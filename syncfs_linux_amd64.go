@@ -0,0 +1,5 @@
+package buildworker
+
+// sysSyncfs is the number of the syncfs system
+// call, which the syscall package lacks on amd64.
+const sysSyncfs = 306
@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !386
+// +build linux,!amd64,!386
+
+package buildworker
+
+import "syscall"
+
+// sysSyncfs is the number of the syncfs system call.
+const sysSyncfs = syscall.SYS_SYNCFS
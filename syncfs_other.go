@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncFileSystem flushes the files in path to disk one by
+// one, since there is no way to sync just the file system
+// that it is on.
+func syncFileSystem(path string) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
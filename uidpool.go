@@ -0,0 +1,98 @@
+package buildworker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UidRange is a range of uids, like "100000-100999", from
+// which each build environment leases a uid for as long as
+// it is open. The build environment's temporary GOPATH is
+// owned by that uid (and the gid with the same number), and
+// its commands run as it, so that concurrent builds cannot
+// read or tamper with each other's files and processes. If
+// empty, all build environments use UidGid. Commands that
+// change the master GOPATH always run as UidGid, which
+// should not be in the range.
+var UidRange string
+
+// uidPool keeps track of the uids that are leased
+// by open build environments.
+var uidPool = struct {
+	sync.Mutex
+	leased map[int]bool
+}{leased: make(map[int]bool)}
+
+// leaseUid returns a uid from UidRange that is not leased
+// by another build environment. It must be released with
+// releaseUid when no longer needed. If UidRange is empty,
+// it returns UidGid.
+func leaseUid() (int, error) {
+	if UidRange == "" {
+		return UidGid, nil
+	}
+	first, last, err := parseUidRange(UidRange)
+	if err != nil {
+		return -1, err
+	}
+	uidPool.Lock()
+	defer uidPool.Unlock()
+	for uid := first; uid <= last; uid++ {
+		if !uidPool.leased[uid] {
+			uidPool.leased[uid] = true
+			return uid, nil
+		}
+	}
+	return -1, fmt.Errorf("all %d uids in %s are in use", last-first+1, UidRange)
+}
+
+// releaseUid returns uid to the pool so that another
+// build environment can lease it. It does nothing if
+// UidRange is empty.
+func releaseUid(uid int) {
+	if UidRange == "" {
+		return
+	}
+	uidPool.Lock()
+	delete(uidPool.leased, uid)
+	uidPool.Unlock()
+}
+
+// parseUidRange parses a range of uids like "100000-100999"
+// and returns the first and last uid in it.
+func parseUidRange(r string) (first, last int, err error) {
+	parts := strings.Split(r, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("uid range must be like first-last: %s", r)
+	}
+	first, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("first uid of range: %v", err)
+	}
+	last, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("last uid of range: %v", err)
+	}
+	if first < 1 || int64(last) > 0xFFFFFFFE || first > last {
+		return 0, 0, fmt.Errorf("invalid uid range: %s", r)
+	}
+	return first, last, nil
+}
+
+// CheckUidRange returns an error if UidRange is set
+// but is not a valid range of uids to lease.
+func CheckUidRange() error {
+	if UidRange == "" {
+		return nil
+	}
+	first, last, err := parseUidRange(UidRange)
+	if err != nil {
+		return err
+	}
+	if UidGid >= first && UidGid <= last {
+		return fmt.Errorf("uid range %s must not include uid %d", UidRange, UidGid)
+	}
+	return nil
+}
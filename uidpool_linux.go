@@ -0,0 +1,89 @@
+package buildworker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killUidProcesses kills all processes whose real or
+// effective uid is uid. Since processes may fork while
+// they are being killed, it tries several times until
+// none are left.
+func killUidProcesses(uid int) error {
+	for i := 0; i < 10; i++ {
+		pids, err := uidProcesses(uid)
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(time.Duration(i*10) * time.Millisecond)
+	}
+	return fmt.Errorf("processes owned by uid %d are still running", uid)
+}
+
+// uidProcesses returns the pids of processes whose real
+// or effective uid is uid, according to /proc.
+func uidProcesses(uid int) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue // not a process
+		}
+		uids, err := processUids(filepath.Join("/proc", entry.Name(), "status"))
+		if err != nil {
+			continue // probably exited already
+		}
+		if len(uids) >= 2 && (uids[0] == uid || uids[1] == uid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// processUids returns the real, effective, saved,
+// and file system uids from the status file of a
+// process in /proc.
+func processUids(statusFile string) ([]int, error) {
+	file, err := os.Open(statusFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Uid:" {
+			continue
+		}
+		var uids []int
+		for _, field := range fields[1:] {
+			uid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, err
+			}
+			uids = append(uids, uid)
+		}
+		return uids, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no uids in %s", statusFile)
+}
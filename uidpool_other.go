@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package buildworker
+
+// killUidProcesses does nothing, since processes
+// cannot be found by uid on this platform.
+func killUidProcesses(uid int) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package buildworker
+
+import "testing"
+
+func TestParseUidRange(t *testing.T) {
+	for i, test := range []struct {
+		input       string
+		expectFirst int
+		expectLast  int
+		shouldErr   bool
+	}{
+		{input: "100000-100999", expectFirst: 100000, expectLast: 100999},
+		{input: " 5 - 5 ", expectFirst: 5, expectLast: 5},
+		{input: "100000", shouldErr: true},
+		{input: "1-2-3", shouldErr: true},
+		{input: "a-10", shouldErr: true},
+		{input: "10-b", shouldErr: true},
+		{input: "0-10", shouldErr: true},
+		{input: "-1-10", shouldErr: true},
+		{input: "10-9", shouldErr: true},
+		{input: "1-4294967295", shouldErr: true},
+	} {
+		first, last, err := parseUidRange(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d (%q): Expected an error, got none", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d (%q): Expected no error, got: %v", i, test.input, err)
+			continue
+		}
+		if first != test.expectFirst || last != test.expectLast {
+			t.Errorf("Test %d (%q): Expected %d-%d, got %d-%d",
+				i, test.input, test.expectFirst, test.expectLast, first, last)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package buildworker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ResourceUsage is the resources used by the commands
+// of one phase of a build environment, like "go test"
+// or "git fetch".
+type ResourceUsage struct {
+	Commands    int     `json:"commands"`     // number of commands run
+	WallTime    float64 `json:"wall_time"`    // seconds
+	UserTime    float64 `json:"user_time"`    // seconds of CPU time in user mode
+	SystemTime  float64 `json:"system_time"`  // seconds of CPU time in kernel mode
+	MaxRSS      int64   `json:"max_rss"`      // bytes; the largest of any command
+	GopathBytes int64   `json:"gopath_bytes"` // growth of the temporary GOPATH
+}
+
+func (u ResourceUsage) String() string {
+	return fmt.Sprintf("%d commands, wall %.1fs, user %.1fs, sys %.1fs, max RSS %d KiB, GOPATH +%d KiB",
+		u.Commands, u.WallTime, u.UserTime, u.SystemTime, u.MaxRSS/1024, u.GopathBytes/1024)
+}
+
+// UsageSummary returns a one-line summary of the resources
+// used in each phase, sorted by phase, for logging.
+func (r *Report) UsageSummary() string {
+	phases := make([]string, 0, len(r.Usage))
+	for phase := range r.Usage {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for i, phase := range phases {
+		phases[i] = fmt.Sprintf("[%s: %s]", phase, r.Usage[phase])
+	}
+	return fmt.Sprintf("temporary GOPATH %d KiB; %s", r.TemporaryGopathBytes/1024, strings.Join(phases, " "))
+}
+
+// recordUsage adds the resources used by a command of phase,
+// which ran for wall time and exited with state, to the
+// report.
+func (be BuildEnv) recordUsage(phase string, wall time.Duration, state *os.ProcessState) {
+	usage := be.phaseUsage(phase)
+	usage.Commands++
+	usage.WallTime += wall.Seconds()
+	if state != nil {
+		usage.UserTime += state.UserTime().Seconds()
+		usage.SystemTime += state.SystemTime().Seconds()
+		if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+			maxRSS := int64(rusage.Maxrss)
+			if runtime.GOOS != "darwin" {
+				maxRSS *= 1024 // kilobytes everywhere else
+			}
+			if maxRSS > usage.MaxRSS {
+				usage.MaxRSS = maxRSS
+			}
+		}
+	}
+}
+
+// phaseUsage returns the resources used in phase
+// so far, adding the phase to the report if needed.
+func (be BuildEnv) phaseUsage(phase string) *ResourceUsage {
+	if be.Report.Usage == nil {
+		be.Report.Usage = make(map[string]*ResourceUsage)
+	}
+	usage, ok := be.Report.Usage[phase]
+	if !ok {
+		usage = new(ResourceUsage)
+		be.Report.Usage[phase] = usage
+	}
+	return usage
+}
+
+// gopathUsage keeps track of the size of the temporary
+// GOPATH of a build environment. Measuring it means walking
+// the whole GOPATH (see dirSize), so it is only measured
+// when the phase of the commands that run changes, not after
+// every command; the growth in between is attributed to the
+// phase that ended.
+type gopathUsage struct {
+	size  int64  // as last measured; -1 if it may have changed since
+	phase string // the phase of the last command
+	start int64  // the size when that phase began
+}
+
+// beginPhase is called before a command of phase runs. If
+// the last command was of another phase, it ends that phase
+// (see endPhase) and returns an error if the temporary GOPATH
+// exceeds the DiskQuota.
+func (be BuildEnv) beginPhase(phase string) error {
+	if be.tmpGopath == "" || be.gopathUsage == nil || be.gopathUsage.phase == phase {
+		return nil
+	}
+	size := be.endPhase()
+	be.gopathUsage.phase = phase
+	if DiskQuota > 0 && size > DiskQuota {
+		return fmt.Errorf("temporary GOPATH uses %d bytes: %v", size, errDiskQuota)
+	}
+	return nil
+}
+
+// endPhase measures the temporary GOPATH, unless nothing
+// changed it since it was last measured, and adds how much
+// it grew since the current phase began to the resources
+// used in that phase. The report is updated with the size,
+// which is returned. It is called when the phase changes,
+// and should be called once the build environment is done
+// running commands, so that the last phase is counted too.
+func (be BuildEnv) endPhase() int64 {
+	if be.tmpGopath == "" || be.gopathUsage == nil {
+		return 0
+	}
+	gu := be.gopathUsage
+	if gu.size < 0 {
+		gu.size = dirSize(be.tmpGopath)
+	}
+	if gu.phase != "" && gu.size > gu.start {
+		be.phaseUsage(gu.phase).GopathBytes += gu.size - gu.start
+	}
+	gu.start = gu.size
+	be.Report.TemporaryGopathBytes = gu.size
+	return gu.size
+}
+
+// gopathChanged records that the temporary GOPATH
+// may have changed since it was last measured.
+func (be BuildEnv) gopathChanged() {
+	if be.gopathUsage != nil {
+		be.gopathUsage.size = -1
+	}
+}
+
+// commandPhase returns the name of the phase that a command
+// running path with args belongs to: the name of the program
+// and, if it has one, its subcommand (like "go test").
+func commandPhase(path string, args []string) string {
+	phase := filepath.Base(path)
+	if len(args) > 0 {
+		phase += " " + args[0]
+	}
+	return phase
+}
+
+// dirSize returns the total size in bytes of the files in
+// dir and its subdirectories that take up space of their own:
+// file systems mounted below dir (like the overlays of the
+// overlay ProvisionStrategy, whose upper layers are counted
+// where they are) are skipped, and so are files with more
+// than one hard link (like those of the hardlink strategy,
+// which share their data with the master GOPATH). Files
+// that cannot be read are not counted.
+func dirSize(dir string) int64 {
+	rootInfo, err := os.Lstat(dir)
+	if err != nil {
+		return 0
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if info.IsDir() && st.Dev != rootDev {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && st.Nlink == 1 {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}